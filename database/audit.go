@@ -0,0 +1,103 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+type auditEntryDB struct {
+	ID     uint      `gorm:"primaryKey"`
+	Time   time.Time `gorm:"index"`
+	Actor  string
+	Target string `gorm:"index"`
+	Action string
+	// Changes is the JSON encoding of the []spec.FieldChange
+	Changes   string `gorm:"type:text"`
+	IP        string
+	RequestID string
+}
+
+func toAuditEntryDB(entry spec.AuditEntry) (auditEntryDB, error) {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return auditEntryDB{}, err
+	}
+	return auditEntryDB{
+		ID:        entry.ID,
+		Time:      entry.Time,
+		Actor:     entry.Actor,
+		Target:    entry.Target,
+		Action:    entry.Action,
+		Changes:   string(changes),
+		IP:        entry.IP,
+		RequestID: entry.RequestID,
+	}, nil
+}
+
+func toSpecAuditEntry(entry auditEntryDB) (spec.AuditEntry, error) {
+	var changes []spec.FieldChange
+	err := json.Unmarshal([]byte(entry.Changes), &changes)
+	if err != nil {
+		return spec.AuditEntry{}, err
+	}
+	return spec.AuditEntry{
+		ID:        entry.ID,
+		Time:      entry.Time,
+		Actor:     entry.Actor,
+		Target:    entry.Target,
+		Action:    entry.Action,
+		Changes:   changes,
+		IP:        entry.IP,
+		RequestID: entry.RequestID,
+	}, nil
+}
+
+// AppendAudit implements spec.AuditLog.
+func (d dbWrapper) AppendAudit(entry spec.AuditEntry) error {
+	entryDb, err := toAuditEntryDB(entry)
+	if err != nil {
+		return err
+	}
+	ret := d.DB.Create(&entryDb)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
+
+// ReadAudit implements spec.AuditLog.
+func (d dbWrapper) ReadAudit(query spec.AuditQuery) ([]spec.AuditEntry, error) {
+	tx := d.DB.Order("time DESC, id DESC")
+	if query.Target != "" {
+		tx = tx.Where("target = ?", query.Target)
+	}
+	if !query.Since.IsZero() {
+		tx = tx.Where("time >= ?", query.Since)
+	}
+	if !query.Until.IsZero() {
+		tx = tx.Where("time < ?", query.Until)
+	}
+	if query.Limit > 0 {
+		tx = tx.Limit(query.Limit)
+	}
+	var records []auditEntryDB
+	ret := tx.Find(&records)
+	if ret.Error != nil {
+		return []spec.AuditEntry{}, ret.Error
+	}
+	var entries []spec.AuditEntry
+	for _, r := range records {
+		entry, err := toSpecAuditEntry(r)
+		if err != nil {
+			return []spec.AuditEntry{}, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
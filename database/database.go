@@ -1,22 +1,47 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"slices"
+	"time"
 
 	"github.com/jameshw-dev01/user-api/spec"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 type userDB struct {
-	Username string `gorm:"primaryKey"`
+	Username     string `gorm:"primaryKey"`
+	Hash         string
+	Email        string
+	Name         string
+	Age          uint
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
+	Admin        bool
+	AuthSource   string `gorm:"size:16"`
+	Version      uint
+	// Status defaults to active for users created before it existed
+	Status          string `gorm:"size:16;default:active"`
+	StatusReason    string
+	StatusChangedAt sql.NullTime
+	// PreviousStatus is empty for users deleted before it existed
+	PreviousStatus       string `gorm:"size:16"`
+	PreviousStatusReason string
+	DeletedAt            gorm.DeletedAt `gorm:"index"`
+}
+
+type recoveryCodeDB struct {
+	ID       uint   `gorm:"primaryKey"`
+	Username string `gorm:"index"`
 	Hash     string
-	Email    string
-	Name     string
-	Age      uint
 }
 
 type dbWrapper struct {
@@ -25,24 +50,60 @@ type dbWrapper struct {
 
 func toUserDB(user spec.User) userDB {
 	return userDB{
-		Username: user.Username,
-		Hash:     user.Hash,
-		Email:    user.Email,
-		Name:     user.Name,
-		Age:      user.Age,
+		Username:             user.Username,
+		Hash:                 user.Hash,
+		Email:                user.Email,
+		Name:                 user.Name,
+		Age:                  user.Age,
+		TOTPSecret:           user.TOTPSecret,
+		TOTPEnabled:          user.TOTPEnabled,
+		TOTPLastStep:         user.TOTPLastStep,
+		Admin:                user.Admin,
+		AuthSource:           user.AuthSource,
+		Version:              user.Version,
+		Status:               user.Status,
+		StatusReason:         user.StatusReason,
+		StatusChangedAt:      sql.NullTime{Time: user.StatusChangedAt, Valid: !user.StatusChangedAt.IsZero()},
+		PreviousStatus:       user.PreviousStatus,
+		PreviousStatusReason: user.PreviousStatusReason,
+		DeletedAt:            gorm.DeletedAt{Time: user.DeletedAt, Valid: !user.DeletedAt.IsZero()},
 	}
 }
 
 func ToSpecUser(user userDB) spec.User {
 	return spec.User{
-		Username: user.Username,
-		Hash:     user.Hash,
-		Email:    user.Email,
-		Name:     user.Name,
-		Age:      user.Age,
+		Username:             user.Username,
+		Hash:                 user.Hash,
+		Email:                user.Email,
+		Name:                 user.Name,
+		Age:                  user.Age,
+		TOTPSecret:           user.TOTPSecret,
+		TOTPEnabled:          user.TOTPEnabled,
+		TOTPLastStep:         user.TOTPLastStep,
+		Admin:                user.Admin,
+		AuthSource:           user.AuthSource,
+		Version:              user.Version,
+		Status:               user.Status,
+		StatusReason:         user.StatusReason,
+		StatusChangedAt:      user.StatusChangedAt.Time,
+		PreviousStatus:       user.PreviousStatus,
+		PreviousStatusReason: user.PreviousStatusReason,
+		DeletedAt:            user.DeletedAt.Time,
 	}
 }
 
+// WithContext implements spec.DbInterface.
+func (d dbWrapper) WithContext(ctx context.Context) spec.DbInterface {
+	return dbWrapper{DB: d.DB.WithContext(ctx)}
+}
+
+// Transaction implements spec.DbInterface.
+func (d dbWrapper) Transaction(fn func(tx spec.DbInterface) error) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		return fn(dbWrapper{DB: tx})
+	})
+}
+
 // Create implements spec.DbInterface.
 func (d dbWrapper) Create(user spec.User) error {
 	userDb := toUserDB(user)
@@ -69,6 +130,73 @@ func (d dbWrapper) Delete(user spec.User) error {
 	return nil
 }
 
+// UpdateStatus implements spec.DbInterface.
+func (d dbWrapper) UpdateStatus(user spec.User) error {
+	userDb := toUserDB(user)
+	userDb.Version++
+	ret := d.DB.Unscoped().Model(&userDb).
+		Where("version = ?", user.Version).
+		Select("Status", "StatusReason", "StatusChangedAt", "PreviousStatus", "PreviousStatusReason", "Version").
+		Updates(userDb)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return spec.ErrVersionConflict
+	}
+	return nil
+}
+
+// ReadDeleted implements spec.DbInterface.
+func (d dbWrapper) ReadDeleted(username string) (spec.User, error) {
+	var user userDB
+	ret := d.DB.Unscoped().Where("username = ? AND deleted_at IS NOT NULL", username).First(&user)
+	if ret.Error != nil {
+		return spec.User{}, ret.Error
+	}
+	return ToSpecUser(user), nil
+}
+
+// Restore implements spec.DbInterface.
+func (d dbWrapper) Restore(username string) error {
+	ret := d.DB.Unscoped().Model(&userDB{}).
+		Where("username = ? AND deleted_at IS NOT NULL", username).
+		Update("deleted_at", nil)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
+
+// PurgeDeleted implements spec.DbInterface.
+func (d dbWrapper) PurgeDeleted(cutoff time.Time) ([]string, error) {
+	var usernames []string
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		ret := tx.Unscoped().Model(&userDB{}).Where("deleted_at < ?", cutoff).Pluck("username", &usernames)
+		if ret.Error != nil || len(usernames) == 0 {
+			return ret.Error
+		}
+		ret = tx.Unscoped().Where("username IN ?", usernames).Delete(&userDB{})
+		if ret.Error != nil {
+			return ret.Error
+		}
+		for _, model := range []interface{}{&recoveryCodeDB{}, &credentialDB{}, &sessionDB{}, &passwordResetDB{}, &apiKeyDB{}, &oauthConsentDB{}, &loginAttemptDB{}} {
+			ret = tx.Where("username IN ?", usernames).Delete(model)
+			if ret.Error != nil {
+				return ret.Error
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usernames, nil
+}
+
 // ReadAll implements spec.DbInterface.
 func (d dbWrapper) ReadAll() ([]spec.User, error) {
 	var records []userDB
@@ -96,46 +224,184 @@ func (d dbWrapper) Read(username string) (spec.User, error) {
 	return ToSpecUser(user), nil
 }
 
+// updateFields are the User fields written by Update.
+var updateFields = []string{"Hash", "Email", "Name", "Age", "Admin"}
+
 // Update implements spec.DbInterface.
 func (d dbWrapper) Update(user spec.User) error {
+	return d.UpdateFields(user, updateFields)
+}
+
+// UpdateFields implements spec.DbInterface.
+func (d dbWrapper) UpdateFields(user spec.User, fields []string) error {
 	userDb := toUserDB(user)
-	ret := d.DB.Model(&userDb).Updates(userDb)
+	userDb.Version++
+	ret := d.DB.Model(&userDb).
+		Where("version = ?", user.Version).
+		Select(slices.Concat(fields, []string{"Version"})).
+		Updates(userDb)
 	if ret.Error != nil {
 		return ret.Error
 	}
+	if ret.RowsAffected != 1 {
+		return spec.ErrVersionConflict
+	}
 	return nil
 }
 
-func InitDB(dbname string) {
+// UpdateTOTP implements spec.DbInterface.
+func (d dbWrapper) UpdateTOTP(user spec.User) error {
+	userDb := toUserDB(user)
+	ret := d.DB.Model(&userDb).Select("TOTPSecret", "TOTPEnabled").Updates(userDb)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
+
+// UseTOTPStep implements spec.DbInterface.
+func (d dbWrapper) UseTOTPStep(username string, step int64) (bool, error) {
+	ret := d.DB.Model(&userDB{}).
+		Where("username = ? AND totp_last_step < ?", username, step).
+		Update("totp_last_step", step)
+	if ret.Error != nil {
+		return false, ret.Error
+	}
+	return ret.RowsAffected == 1, nil
+}
+
+// ReplaceRecoveryCodes implements spec.DbInterface.
+func (d dbWrapper) ReplaceRecoveryCodes(username string, hashes []string) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		ret := tx.Where("username = ?", username).Delete(&recoveryCodeDB{})
+		if ret.Error != nil {
+			return ret.Error
+		}
+		if len(hashes) == 0 {
+			return nil
+		}
+		var records []recoveryCodeDB
+		for _, hash := range hashes {
+			records = append(records, recoveryCodeDB{Username: username, Hash: hash})
+		}
+		return tx.Create(&records).Error
+	})
+}
+
+// ConsumeRecoveryCode implements spec.DbInterface.
+func (d dbWrapper) ConsumeRecoveryCode(username string, hash string) (bool, error) {
+	ret := d.DB.Where("username = ? AND hash = ?", username, hash).Delete(&recoveryCodeDB{})
+	if ret.Error != nil {
+		return false, ret.Error
+	}
+	return ret.RowsAffected == 1, nil
+}
+
+// tables are the models of every table, in migration order.
+var tables = []interface{}{
+	&userDB{},
+	&recoveryCodeDB{},
+	&credentialDB{},
+	&sessionDB{},
+	&passwordResetDB{},
+	&apiKeyDB{},
+	&oauthClientDB{},
+	&oauthConsentDB{},
+	&auditEntryDB{},
+	&loginAttemptDB{},
+	&idempotencyKeyDB{},
+}
+
+// InitDB creates the database if it does not exist.
+func InitDB(dbname string) error {
 	password := os.Getenv("MYSQL_ROOT_PASSWORD")
 	db, err := sql.Open("mysql", "root:"+password+"@tcp(127.0.0.1:3306)/")
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer db.Close()
 
 	_, err = db.Exec("CREATE DATABASE IF NOT EXISTS " + dbname)
-	if err != nil {
-		panic(err)
-	}
+	return err
 }
 
-func GetDBConnection(resetDb bool, dbname string) spec.DbInterface {
-	InitDB(dbname)
+// Connect opens the database, creating and migrating it as needed, and
+// returns an error instead of exiting if MySQL cannot be reached.
+func Connect(resetDb bool, dbname string) (spec.DbInterface, error) {
+	err := InitDB(dbname)
+	if err != nil {
+		return nil, fmt.Errorf("creating database: %w", err)
+	}
 	password := os.Getenv("MYSQL_ROOT_PASSWORD")
 
 	dsn := "root:" + password + "@tcp(localhost:3306)/" + dbname + "?charset=utf8mb4&parseTime=True&loc=Local"
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+		Logger: slogLogger{level: logger.Warn, slowThreshold: 200 * time.Millisecond},
+	})
 	if err != nil {
-		log.Fatal("Failed to connect database")
+		return nil, fmt.Errorf("connecting to database: %w", err)
 	}
-	err = db.AutoMigrate(&userDB{})
-	if err != nil {
-		log.Fatal("Failed to migrate User table")
+	for _, table := range tables {
+		err = db.AutoMigrate(table)
+		if err != nil {
+			return nil, fmt.Errorf("migrating %T: %w", table, err)
+		}
 	}
 	if resetDb {
-		db.Delete(&userDB{}, "1=1")
+		for _, table := range tables {
+			db.Unscoped().Delete(table, "1=1")
+		}
 	}
 	wrap := dbWrapper{DB: db}
-	return wrap
+	return wrap, nil
+}
+
+func GetDBConnection(resetDb bool, dbname string) spec.DbInterface {
+	db, err := Connect(resetDb, dbname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// Ping implements spec.DbInterface.
+func (d dbWrapper) Ping() error {
+	db, err := d.DB.DB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(d.DB.Statement.Context)
+}
+
+// Close implements spec.DbInterface.
+func (d dbWrapper) Close() error {
+	db, err := d.DB.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// CheckMigrations implements spec.DbInterface.
+func (d dbWrapper) CheckMigrations() error {
+	migrator := d.DB.Migrator()
+	for _, table := range tables {
+		statement := &gorm.Statement{DB: d.DB}
+		err := statement.Parse(table)
+		if err != nil {
+			return err
+		}
+		if !migrator.HasTable(table) {
+			return fmt.Errorf("table %s is missing", statement.Schema.Table)
+		}
+		for _, field := range statement.Schema.Fields {
+			if field.DBName != "" && !migrator.HasColumn(table, field.DBName) {
+				return fmt.Errorf("column %s.%s is missing", statement.Schema.Table, field.DBName)
+			}
+		}
+	}
+	return nil
 }
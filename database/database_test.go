@@ -1,8 +1,10 @@
 package database
 
 import (
+	"errors"
 	"slices"
 	"testing"
+	"time"
 
 	"github.com/jameshw-dev01/user-api/spec"
 	"github.com/stretchr/testify/assert"
@@ -89,7 +91,64 @@ func TestUpdate(t *testing.T) {
 	db.Update(user1_updated)
 	retrieved, err := db.Read("john_doe")
 	assert.Equal(t, nil, err)
+	user1_updated.Version++
 	assert.Equal(t, user1_updated, retrieved)
+
+	user1_updated.Age = 0
+	assert.Equal(t, nil, db.Update(user1_updated))
+	retrieved, _ = db.Read("john_doe")
+	assert.Equal(t, uint(0), retrieved.Age, "zero age not written")
+}
+
+func TestUpdateFields(t *testing.T) {
+	db := GetDBConnection(true, "TEST")
+	user1 := testData()[0]
+	db.Create(user1)
+	updated := user1
+	updated.Age = 0
+	updated.Name = ""
+	updated.Email = "other@test.com"
+	assert.Nil(t, db.UpdateFields(updated, []string{"Age", "Email"}))
+	retrieved, err := db.Read(user1.Username)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(0), retrieved.Age)
+	assert.Equal(t, "other@test.com", retrieved.Email)
+	assert.Equal(t, user1.Name, retrieved.Name, "field outside the mask written")
+	assert.ErrorIs(t, db.UpdateFields(updated, []string{"Age"}), spec.ErrVersionConflict)
+}
+
+func TestTransaction(t *testing.T) {
+	db := GetDBConnection(true, "TEST")
+	users := testData()
+	err := db.Transaction(func(tx spec.DbInterface) error {
+		tx.Create(users[0])
+		return errors.New("rolled back")
+	})
+	assert.NotNil(t, err)
+	_, err = db.Read(users[0].Username)
+	assert.NotNil(t, err, "rolled back user created")
+	err = db.Transaction(func(tx spec.DbInterface) error {
+		return tx.Create(users[1])
+	})
+	assert.Nil(t, err)
+	_, err = db.Read(users[1].Username)
+	assert.Nil(t, err)
+}
+
+func TestUpdateVersionConflict(t *testing.T) {
+	db := GetDBConnection(true, "TEST")
+	user1 := testData()[0]
+	db.Create(user1)
+	first := user1
+	first.Name = "First"
+	assert.Nil(t, db.Update(first))
+	second := user1
+	second.Name = "Second"
+	assert.ErrorIs(t, db.Update(second), spec.ErrVersionConflict)
+	retrieved, err := db.Read(user1.Username)
+	assert.Nil(t, err)
+	assert.Equal(t, "First", retrieved.Name)
+	assert.Equal(t, uint(1), retrieved.Version)
 }
 
 func TestDelete(t *testing.T) {
@@ -114,3 +173,178 @@ func TestDelete(t *testing.T) {
 	assert.Equal(t, -1, idx1, "user2 not deleted")
 	assert.Equal(t, -1, idx2, "user3 not deleted")
 }
+
+func TestRecoveryCodes(t *testing.T) {
+	db := GetDBConnection(true, "TEST")
+	user1 := testData()[0]
+	db.Create(user1)
+	err := db.ReplaceRecoveryCodes(user1.Username, []string{"hash1", "hash2"})
+	assert.Equal(t, nil, err)
+	used, err := db.ConsumeRecoveryCode(user1.Username, "hash1")
+	assert.Equal(t, nil, err)
+	assert.True(t, used)
+	used, _ = db.ConsumeRecoveryCode(user1.Username, "hash1")
+	assert.False(t, used, "recovery code used twice")
+	db.ReplaceRecoveryCodes(user1.Username, []string{"hash3"})
+	used, _ = db.ConsumeRecoveryCode(user1.Username, "hash2")
+	assert.False(t, used, "old recovery code survived replacement")
+}
+
+func TestAudit(t *testing.T) {
+	db := GetDBConnection(true, "TEST")
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	db.AppendAudit(spec.AuditEntry{Time: start, Actor: "john_doe", Target: "john_doe", Action: "user.create"})
+	err := db.AppendAudit(spec.AuditEntry{
+		Time:    start.Add(30 * time.Second),
+		Actor:   "john_doe",
+		Target:  "john_doe",
+		Action:  "user.update",
+		Changes: []spec.FieldChange{{Field: "name", Before: "John", After: "John Doe"}},
+	})
+	assert.Equal(t, nil, err)
+	db.AppendAudit(spec.AuditEntry{Time: start, Actor: "jane_smith", Target: "jane_smith", Action: "user.create"})
+
+	entries, err := db.ReadAudit(spec.AuditQuery{Target: "john_doe"})
+	assert.Equal(t, nil, err)
+	if len(entries) != 2 {
+		t.Fatal("wrong number of entries")
+	}
+	assert.Equal(t, "user.update", entries[0].Action, "entries not newest first")
+	assert.Equal(t, []spec.FieldChange{{Field: "name", Before: "John", After: "John Doe"}}, entries[0].Changes)
+
+	entries, _ = db.ReadAudit(spec.AuditQuery{Target: "john_doe", Since: start.Add(time.Second)})
+	assert.Equal(t, 1, len(entries))
+	entries, _ = db.ReadAudit(spec.AuditQuery{Until: start.Add(time.Second)})
+	assert.Equal(t, 2, len(entries))
+}
+
+func TestLoginAttempts(t *testing.T) {
+	db := GetDBConnection(true, "TEST")
+	user1 := testData()[0]
+	db.Create(user1)
+	start := time.Now().Truncate(time.Second)
+	for i, outcome := range []string{"invalid_credentials", "success", "success"} {
+		err := db.CreateLoginAttempt(spec.LoginAttempt{
+			Username: user1.Username,
+			Time:     start.Add(time.Duration(i) * time.Second),
+			IP:       "192.0.2.1",
+			Method:   "password",
+			Outcome:  outcome,
+		})
+		assert.Equal(t, nil, err)
+	}
+	attempts, err := db.ReadLoginAttempts(user1.Username, 2)
+	assert.Equal(t, nil, err)
+	if len(attempts) != 2 {
+		t.Fatal("wrong number of attempts")
+	}
+	assert.Equal(t, start.Add(2*time.Second), attempts[0].Time.Local(), "attempts not newest first")
+	pruned, err := db.PruneLoginAttempts(start.Add(time.Second))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1), pruned)
+	attempts, _ = db.ReadLoginAttempts(user1.Username, 10)
+	assert.Equal(t, 2, len(attempts))
+	db.Delete(user1)
+	db.PurgeDeleted(time.Now().Add(time.Minute))
+	attempts, _ = db.ReadLoginAttempts(user1.Username, 10)
+	assert.Equal(t, 0, len(attempts), "login history survived purging the user")
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	db := GetDBConnection(true, "TEST")
+	now := time.Now().Truncate(time.Second)
+	response := spec.IdempotentResponse{Key: "john_doe:first", Fingerprint: []byte{1, 2, 3}, ExpiresAt: now.Add(time.Minute)}
+	first, claimed, err := db.ClaimIdempotencyKey(response)
+	assert.Equal(t, nil, err)
+	assert.True(t, claimed)
+	first, claimed, _ = db.ClaimIdempotencyKey(spec.IdempotentResponse{Key: "john_doe:first", ExpiresAt: now.Add(time.Minute)})
+	assert.False(t, claimed)
+	assert.Equal(t, []byte{1, 2, 3}, first.Fingerprint)
+	assert.Equal(t, 0, first.Status, "a running request has a status")
+
+	response.Status = 201
+	response.ContentType = "application/json"
+	response.Body = []byte(`{"name": "John Doe"}`)
+	assert.Equal(t, nil, db.CompleteIdempotencyKey(response))
+	first, _, _ = db.ClaimIdempotencyKey(response)
+	assert.Equal(t, 201, first.Status)
+	assert.Equal(t, response.Body, first.Body)
+
+	// an expired response no longer holds the key
+	expired := spec.IdempotentResponse{Key: "john_doe:second", ExpiresAt: now.Add(-time.Minute)}
+	db.ClaimIdempotencyKey(expired)
+	_, claimed, _ = db.ClaimIdempotencyKey(spec.IdempotentResponse{Key: "john_doe:second", ExpiresAt: now.Add(2 * time.Minute)})
+	assert.True(t, claimed)
+	assert.Equal(t, nil, db.DeleteIdempotencyKey("john_doe:second"))
+	_, claimed, _ = db.ClaimIdempotencyKey(spec.IdempotentResponse{Key: "john_doe:second", ExpiresAt: now.Add(2 * time.Minute)})
+	assert.True(t, claimed)
+
+	db.ClaimIdempotencyKey(spec.IdempotentResponse{Key: "john_doe:third", ExpiresAt: now.Add(-time.Minute)})
+	pruned, err := db.PruneIdempotencyKeys(now, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(2), pruned, "expired and oldest responses not pruned")
+	_, claimed, _ = db.ClaimIdempotencyKey(spec.IdempotentResponse{Key: "john_doe:second", ExpiresAt: now.Add(time.Minute)})
+	assert.False(t, claimed, "newest response pruned")
+}
+
+func TestSoftDelete(t *testing.T) {
+	db := GetDBConnection(true, "TEST")
+	users := testData()
+	db.Create(users[0])
+	db.Create(users[1])
+	db.ReplaceRecoveryCodes(users[0].Username, []string{"hash1"})
+	db.Delete(users[0])
+	db.Delete(users[1])
+
+	_, err := db.Read(users[0].Username)
+	assert.NotEqual(t, nil, err, "deleted user still readable")
+	deleted, err := db.ReadDeleted(users[0].Username)
+	assert.Equal(t, nil, err)
+	assert.False(t, deleted.DeletedAt.IsZero())
+
+	err = db.Restore(users[0].Username)
+	assert.Equal(t, nil, err)
+	restored, err := db.Read(users[0].Username)
+	assert.Equal(t, nil, err)
+	assert.True(t, restored.DeletedAt.IsZero())
+	used, _ := db.ConsumeRecoveryCode(users[0].Username, "hash1")
+	assert.True(t, used, "recovery code lost by soft delete")
+
+	purged, err := db.PurgeDeleted(time.Now().Add(time.Minute))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{users[1].Username}, purged)
+	_, err = db.ReadDeleted(users[1].Username)
+	assert.NotEqual(t, nil, err, "purged user still readable")
+	assert.Equal(t, nil, db.Create(users[1]), "username of purged user not reusable")
+}
+
+func TestUpdateStatus(t *testing.T) {
+	db := GetDBConnection(true, "TEST")
+	user1 := testData()[0]
+	db.Create(user1)
+	retrieved, _ := db.Read(user1.Username)
+	assert.Equal(t, spec.StatusActive, retrieved.Status, "status does not default to active")
+
+	changedAt := time.Now().Truncate(time.Second)
+	user1.Status = spec.StatusSuspended
+	user1.StatusReason = "chargeback"
+	user1.StatusChangedAt = changedAt
+	assert.Equal(t, nil, db.UpdateStatus(user1))
+	assert.ErrorIs(t, db.UpdateStatus(user1), spec.ErrVersionConflict)
+	user1.Version++
+	retrieved, _ = db.Read(user1.Username)
+	assert.Equal(t, spec.StatusSuspended, retrieved.Status)
+	assert.Equal(t, "chargeback", retrieved.StatusReason)
+	assert.True(t, changedAt.Equal(retrieved.StatusChangedAt))
+
+	db.Delete(user1)
+	user1.PreviousStatus, user1.PreviousStatusReason = user1.Status, user1.StatusReason
+	user1.Status = spec.StatusDeleted
+	user1.StatusReason = ""
+	assert.Equal(t, nil, db.UpdateStatus(user1), "status of deleted user not updated")
+	retrieved, _ = db.ReadDeleted(user1.Username)
+	assert.Equal(t, spec.StatusDeleted, retrieved.Status)
+	assert.Equal(t, "", retrieved.StatusReason)
+	assert.Equal(t, spec.StatusSuspended, retrieved.PreviousStatus)
+	assert.Equal(t, "chargeback", retrieved.PreviousStatusReason)
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jameshw-dev01/user-api/spec"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type idempotencyKeyDB struct {
+	RequestKey  string `gorm:"primaryKey;size:320"`
+	Fingerprint []byte `gorm:"size:32"`
+	Status      int
+	ContentType string
+	// Body is a blob, so responses of up to 64 KiB are stored
+	Body      []byte    `gorm:"type:blob"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func toIdempotencyKeyDB(response spec.IdempotentResponse) idempotencyKeyDB {
+	return idempotencyKeyDB{
+		RequestKey:  response.Key,
+		Fingerprint: response.Fingerprint,
+		Status:      response.Status,
+		ContentType: response.ContentType,
+		Body:        response.Body,
+		ExpiresAt:   response.ExpiresAt,
+	}
+}
+
+func toSpecIdempotentResponse(record idempotencyKeyDB) spec.IdempotentResponse {
+	return spec.IdempotentResponse{
+		Key:         record.RequestKey,
+		Fingerprint: record.Fingerprint,
+		Status:      record.Status,
+		ContentType: record.ContentType,
+		Body:        record.Body,
+		ExpiresAt:   record.ExpiresAt,
+	}
+}
+
+// ClaimIdempotencyKey implements spec.DbInterface.
+func (d dbWrapper) ClaimIdempotencyKey(response spec.IdempotentResponse) (spec.IdempotentResponse, bool, error) {
+	record := toIdempotencyKeyDB(response)
+	var existing idempotencyKeyDB
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		// an expired response no longer holds the key
+		ret := tx.Where("request_key = ? AND expires_at < ?", record.RequestKey, time.Now()).Delete(&idempotencyKeyDB{})
+		if ret.Error != nil {
+			return ret.Error
+		}
+		ret = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if ret.Error != nil || ret.RowsAffected == 1 {
+			return ret.Error
+		}
+		return tx.Where("request_key = ?", record.RequestKey).First(&existing).Error
+	})
+	if err != nil {
+		return spec.IdempotentResponse{}, false, err
+	}
+	if existing.RequestKey != "" {
+		return toSpecIdempotentResponse(existing), false, nil
+	}
+	return response, true, nil
+}
+
+// CompleteIdempotencyKey implements spec.DbInterface.
+func (d dbWrapper) CompleteIdempotencyKey(response spec.IdempotentResponse) error {
+	record := toIdempotencyKeyDB(response)
+	ret := d.DB.Model(&idempotencyKeyDB{RequestKey: record.RequestKey}).
+		Select("Status", "ContentType", "Body", "ExpiresAt").
+		Updates(&record)
+	return ret.Error
+}
+
+// DeleteIdempotencyKey implements spec.DbInterface.
+func (d dbWrapper) DeleteIdempotencyKey(key string) error {
+	return d.DB.Delete(&idempotencyKeyDB{RequestKey: key}).Error
+}
+
+// PruneIdempotencyKeys implements spec.DbInterface.
+func (d dbWrapper) PruneIdempotencyKeys(cutoff time.Time, keep int) (int64, error) {
+	ret := d.DB.Where("expires_at < ?", cutoff).Delete(&idempotencyKeyDB{})
+	if ret.Error != nil {
+		return 0, ret.Error
+	}
+	pruned := ret.RowsAffected
+	// the expiry of the newest response beyond keep; it and older ones go
+	var beyond []time.Time
+	ret = d.DB.Model(&idempotencyKeyDB{}).Order("expires_at DESC").Offset(keep).Limit(1).Pluck("expires_at", &beyond)
+	if ret.Error != nil || len(beyond) == 0 {
+		return pruned, ret.Error
+	}
+	ret = d.DB.Where("expires_at <= ?", beyond[0]).Delete(&idempotencyKeyDB{})
+	return pruned + ret.RowsAffected, ret.Error
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+type loginAttemptDB struct {
+	ID        uint      `gorm:"primaryKey"`
+	Username  string    `gorm:"index"`
+	Time      time.Time `gorm:"index"`
+	IP        string
+	UserAgent string
+	Method    string
+	Outcome   string
+}
+
+func toLoginAttemptDB(attempt spec.LoginAttempt) loginAttemptDB {
+	return loginAttemptDB{
+		Username:  attempt.Username,
+		Time:      attempt.Time,
+		IP:        attempt.IP,
+		UserAgent: attempt.UserAgent,
+		Method:    attempt.Method,
+		Outcome:   attempt.Outcome,
+	}
+}
+
+func toSpecLoginAttempt(attempt loginAttemptDB) spec.LoginAttempt {
+	return spec.LoginAttempt{
+		Username:  attempt.Username,
+		Time:      attempt.Time,
+		IP:        attempt.IP,
+		UserAgent: attempt.UserAgent,
+		Method:    attempt.Method,
+		Outcome:   attempt.Outcome,
+	}
+}
+
+// CreateLoginAttempt implements spec.DbInterface.
+func (d dbWrapper) CreateLoginAttempt(attempt spec.LoginAttempt) error {
+	attemptDb := toLoginAttemptDB(attempt)
+	ret := d.DB.Create(&attemptDb)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
+
+// ReadLoginAttempts implements spec.DbInterface.
+func (d dbWrapper) ReadLoginAttempts(username string, limit int) ([]spec.LoginAttempt, error) {
+	var records []loginAttemptDB
+	tx := d.DB.Where("username = ?", username).Order("time DESC, id DESC")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	ret := tx.Find(&records)
+	if ret.Error != nil {
+		return []spec.LoginAttempt{}, ret.Error
+	}
+	var attempts []spec.LoginAttempt
+	for _, a := range records {
+		attempts = append(attempts, toSpecLoginAttempt(a))
+	}
+	return attempts, nil
+}
+
+// PruneLoginAttempts implements spec.DbInterface.
+func (d dbWrapper) PruneLoginAttempts(cutoff time.Time) (int64, error) {
+	ret := d.DB.Where("time < ?", cutoff).Delete(&loginAttemptDB{})
+	return ret.RowsAffected, ret.Error
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jameshw-dev01/user-api/spec"
+	"gorm.io/gorm/clause"
+)
+
+type oauthClientDB struct {
+	ID         string `gorm:"primaryKey"`
+	Name       string
+	SecretHash string
+	// RedirectURIs are separated by spaces, which URIs cannot contain
+	RedirectURIs string
+	CreatedAt    time.Time
+}
+
+type oauthConsentDB struct {
+	Username  string `gorm:"primaryKey"`
+	ClientID  string `gorm:"primaryKey"`
+	Scopes    string
+	CreatedAt time.Time
+}
+
+// CreateOAuthClient implements spec.DbInterface.
+func (d dbWrapper) CreateOAuthClient(client spec.OAuthClient) error {
+	clientDb := oauthClientDB{
+		ID:           client.ID,
+		Name:         client.Name,
+		SecretHash:   client.SecretHash,
+		RedirectURIs: strings.Join(client.RedirectURIs, " "),
+		CreatedAt:    client.CreatedAt,
+	}
+	ret := d.DB.Create(&clientDb)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
+
+// ReadOAuthClient implements spec.DbInterface.
+func (d dbWrapper) ReadOAuthClient(id string) (spec.OAuthClient, error) {
+	var client oauthClientDB
+	ret := d.DB.Where("id = ?", id).First(&client)
+	if ret.Error != nil {
+		return spec.OAuthClient{}, ret.Error
+	}
+	return spec.OAuthClient{
+		ID:           client.ID,
+		Name:         client.Name,
+		SecretHash:   client.SecretHash,
+		RedirectURIs: strings.Fields(client.RedirectURIs),
+		CreatedAt:    client.CreatedAt,
+	}, nil
+}
+
+// SaveOAuthConsent implements spec.DbInterface.
+func (d dbWrapper) SaveOAuthConsent(consent spec.OAuthConsent) error {
+	consentDb := oauthConsentDB{
+		Username:  consent.Username,
+		ClientID:  consent.ClientID,
+		Scopes:    strings.Join(consent.Scopes, " "),
+		CreatedAt: consent.CreatedAt,
+	}
+	ret := d.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&consentDb)
+	return ret.Error
+}
+
+// ReadOAuthConsent implements spec.DbInterface.
+func (d dbWrapper) ReadOAuthConsent(username string, clientID string) (spec.OAuthConsent, error) {
+	var consent oauthConsentDB
+	ret := d.DB.Where("username = ? AND client_id = ?", username, clientID).First(&consent)
+	if ret.Error != nil {
+		return spec.OAuthConsent{}, ret.Error
+	}
+	return toSpecOAuthConsent(consent), nil
+}
+
+// ReadOAuthConsents implements spec.DbInterface.
+func (d dbWrapper) ReadOAuthConsents(username string) ([]spec.OAuthConsent, error) {
+	var records []oauthConsentDB
+	ret := d.DB.Where("username = ?", username).Find(&records)
+	if ret.Error != nil {
+		return []spec.OAuthConsent{}, ret.Error
+	}
+	var consents []spec.OAuthConsent
+	for _, c := range records {
+		consents = append(consents, toSpecOAuthConsent(c))
+	}
+	return consents, nil
+}
+
+func toSpecOAuthConsent(consent oauthConsentDB) spec.OAuthConsent {
+	return spec.OAuthConsent{
+		Username:  consent.Username,
+		ClientID:  consent.ClientID,
+		Scopes:    strings.Fields(consent.Scopes),
+		CreatedAt: consent.CreatedAt,
+	}
+}
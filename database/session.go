@@ -0,0 +1,285 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jameshw-dev01/user-api/spec"
+	"gorm.io/gorm"
+)
+
+type credentialDB struct {
+	ID              uint   `gorm:"primaryKey"`
+	CredentialID    []byte `gorm:"size:255;uniqueIndex"`
+	Username        string `gorm:"index"`
+	PublicKey       []byte
+	AttestationType string
+	Transports      string
+	AAGUID          []byte
+	SignCount       uint32
+	UserPresent     bool
+	UserVerified    bool
+	BackupEligible  bool
+	BackupState     bool
+	CreatedAt       time.Time
+}
+
+type sessionDB struct {
+	TokenHash string `gorm:"primaryKey"`
+	Username  string `gorm:"index"`
+	Method    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func toCredentialDB(credential spec.Credential) credentialDB {
+	return credentialDB{
+		CredentialID:    credential.ID,
+		Username:        credential.Username,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(credential.Transports, ","),
+		AAGUID:          credential.AAGUID,
+		SignCount:       credential.SignCount,
+		UserPresent:     credential.UserPresent,
+		UserVerified:    credential.UserVerified,
+		BackupEligible:  credential.BackupEligible,
+		BackupState:     credential.BackupState,
+		CreatedAt:       credential.CreatedAt,
+	}
+}
+
+func toSpecCredential(credential credentialDB) spec.Credential {
+	var transports []string
+	if credential.Transports != "" {
+		transports = strings.Split(credential.Transports, ",")
+	}
+	return spec.Credential{
+		ID:              credential.CredentialID,
+		Username:        credential.Username,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		AAGUID:          credential.AAGUID,
+		SignCount:       credential.SignCount,
+		UserPresent:     credential.UserPresent,
+		UserVerified:    credential.UserVerified,
+		BackupEligible:  credential.BackupEligible,
+		BackupState:     credential.BackupState,
+		CreatedAt:       credential.CreatedAt,
+	}
+}
+
+// CreateCredential implements spec.DbInterface.
+func (d dbWrapper) CreateCredential(credential spec.Credential) error {
+	credentialDb := toCredentialDB(credential)
+	ret := d.DB.Create(&credentialDb)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
+
+// ReadCredentials implements spec.DbInterface.
+func (d dbWrapper) ReadCredentials(username string) ([]spec.Credential, error) {
+	var records []credentialDB
+	ret := d.DB.Where("username = ?", username).Find(&records)
+	if ret.Error != nil {
+		return []spec.Credential{}, ret.Error
+	}
+	var credentials []spec.Credential
+	for _, c := range records {
+		credentials = append(credentials, toSpecCredential(c))
+	}
+	return credentials, nil
+}
+
+// UpdateCredential implements spec.DbInterface.
+func (d dbWrapper) UpdateCredential(credential spec.Credential) error {
+	ret := d.DB.Model(&credentialDB{}).
+		Where("credential_id = ?", credential.ID).
+		Select("SignCount", "BackupState").
+		Updates(toCredentialDB(credential))
+	return ret.Error
+}
+
+// CreateSession implements spec.DbInterface.
+func (d dbWrapper) CreateSession(session spec.Session) error {
+	sessionDb := sessionDB(session)
+	ret := d.DB.Create(&sessionDb)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
+
+// ReadSession implements spec.DbInterface.
+func (d dbWrapper) ReadSession(tokenHash string) (spec.Session, error) {
+	var session sessionDB
+	ret := d.DB.Where("token_hash = ?", tokenHash).First(&session)
+	if ret.Error != nil {
+		return spec.Session{}, ret.Error
+	}
+	return spec.Session(session), nil
+}
+
+// ReadSessions implements spec.DbInterface.
+func (d dbWrapper) ReadSessions(username string) ([]spec.Session, error) {
+	var records []sessionDB
+	ret := d.DB.Where("username = ?", username).Find(&records)
+	if ret.Error != nil {
+		return []spec.Session{}, ret.Error
+	}
+	var sessions []spec.Session
+	for _, s := range records {
+		sessions = append(sessions, spec.Session(s))
+	}
+	return sessions, nil
+}
+
+// DeleteSession implements spec.DbInterface.
+func (d dbWrapper) DeleteSession(tokenHash string) error {
+	return d.DB.Where("token_hash = ?", tokenHash).Delete(&sessionDB{}).Error
+}
+
+// DeleteSessions implements spec.DbInterface.
+func (d dbWrapper) DeleteSessions(username string, exceptTokenHash string) error {
+	return d.DB.Where("username = ? AND token_hash <> ?", username, exceptTokenHash).Delete(&sessionDB{}).Error
+}
+
+type passwordResetDB struct {
+	TokenHash string `gorm:"primaryKey"`
+	Username  string `gorm:"index"`
+	ExpiresAt time.Time
+}
+
+// CreatePasswordReset implements spec.DbInterface.
+func (d dbWrapper) CreatePasswordReset(reset spec.PasswordReset) error {
+	resetDb := passwordResetDB(reset)
+	ret := d.DB.Create(&resetDb)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
+
+// ConsumePasswordReset implements spec.DbInterface.
+func (d dbWrapper) ConsumePasswordReset(tokenHash string) (spec.PasswordReset, error) {
+	var reset passwordResetDB
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		ret := tx.Where("token_hash = ?", tokenHash).First(&reset)
+		if ret.Error != nil {
+			return ret.Error
+		}
+		ret = tx.Where("token_hash = ?", tokenHash).Delete(&passwordResetDB{})
+		if ret.Error != nil {
+			return ret.Error
+		}
+		// a concurrent request consumed it first
+		if ret.RowsAffected != 1 {
+			return errors.New("password reset already used")
+		}
+		return nil
+	})
+	if err != nil {
+		return spec.PasswordReset{}, err
+	}
+	return spec.PasswordReset(reset), nil
+}
+
+type apiKeyDB struct {
+	ID        string `gorm:"primaryKey"`
+	Username  string `gorm:"index"`
+	Name      string
+	Hash      string
+	Scopes    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func toAPIKeyDB(key spec.APIKey) apiKeyDB {
+	return apiKeyDB{
+		ID:        key.ID,
+		Username:  key.Username,
+		Name:      key.Name,
+		Hash:      key.Hash,
+		Scopes:    strings.Join(key.Scopes, ","),
+		CreatedAt: key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	}
+}
+
+func toSpecAPIKey(key apiKeyDB) spec.APIKey {
+	var scopes []string
+	if key.Scopes != "" {
+		scopes = strings.Split(key.Scopes, ",")
+	}
+	return spec.APIKey{
+		ID:        key.ID,
+		Username:  key.Username,
+		Name:      key.Name,
+		Hash:      key.Hash,
+		Scopes:    scopes,
+		CreatedAt: key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	}
+}
+
+// CreateAPIKey implements spec.DbInterface.
+func (d dbWrapper) CreateAPIKey(key spec.APIKey) error {
+	keyDb := toAPIKeyDB(key)
+	ret := d.DB.Create(&keyDb)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
+
+// ReadAPIKey implements spec.DbInterface.
+func (d dbWrapper) ReadAPIKey(id string) (spec.APIKey, error) {
+	var key apiKeyDB
+	ret := d.DB.Where("id = ?", id).First(&key)
+	if ret.Error != nil {
+		return spec.APIKey{}, ret.Error
+	}
+	return toSpecAPIKey(key), nil
+}
+
+// ReadAPIKeys implements spec.DbInterface.
+func (d dbWrapper) ReadAPIKeys(username string) ([]spec.APIKey, error) {
+	var records []apiKeyDB
+	ret := d.DB.Where("username = ?", username).Order("created_at").Find(&records)
+	if ret.Error != nil {
+		return []spec.APIKey{}, ret.Error
+	}
+	var keys []spec.APIKey
+	for _, k := range records {
+		keys = append(keys, toSpecAPIKey(k))
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey implements spec.DbInterface.
+func (d dbWrapper) DeleteAPIKey(id string) error {
+	ret := d.DB.Where("id = ?", id).Delete(&apiKeyDB{})
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected != 1 {
+		return errors.New("wrong number of rows affected")
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+const (
+	// apiKeyPrefix marks API keys so secret scanners and logs can recognise them
+	apiKeyPrefix = "uak_"
+
+	scopeUsersRead  = "users:read"
+	scopeUsersWrite = "users:write"
+	// scopeAdmin lets a key owned by an admin act on every user
+	scopeAdmin = "admin"
+	// scopeSCIM lets a key owned by an admin provision users through /scim/v2
+	scopeSCIM = "scim"
+)
+
+var apiKeyScopes = []string{scopeUsersRead, scopeUsersWrite, scopeAdmin, scopeSCIM}
+
+// adminOnlyScopes can only be granted to keys owned by admins
+var adminOnlyScopes = []string{scopeAdmin, scopeSCIM}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is a duration such as "720h", defaulting to the configured lifetime
+	ExpiresIn string `json:"expires_in"`
+	// CurrentPassword is required unless the request is made with Basic Auth
+	// or a second factor
+	CurrentPassword string `json:"current_password"`
+}
+
+type APIKeyResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Key is only returned when the key is created
+	Key string `json:"key,omitempty"`
+}
+
+func toAPIKeyResponse(key spec.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:        key.ID,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	}
+}
+
+// apiKeyHeader returns the API key sent in X-API-Key, or as a bearer token for
+// clients such as SCIM provisioning that can only send bearer tokens.
+func apiKeyHeader(c *gin.Context) (string, bool) {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key, true
+	}
+	if token, isBearer := bearerToken(c); isBearer && strings.HasPrefix(token, apiKeyPrefix) {
+		return token, true
+	}
+	return "", false
+}
+
+// newAPIKey returns a key of the form uak_<id>_<secret> and its ID.
+func newAPIKey() (string, string, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	keyID := hex.EncodeToString(id)
+	return apiKeyPrefix + keyID + "_" + base64.RawURLEncoding.EncodeToString(secret), keyID, nil
+}
+
+func parseAPIKey(key string) (string, bool) {
+	rest, found := strings.CutPrefix(key, apiKeyPrefix)
+	if !found {
+		return "", false
+	}
+	id, secret, found := strings.Cut(rest, "_")
+	return id, found && id != "" && secret != ""
+}
+
+// authWithScope authenticates like runAuth, but also accepts an API key in
+// X-API-Key if the key has scope.
+func authWithScope(s *ServerContext, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key, isAPIKey := apiKeyHeader(c); isAPIKey {
+			runAPIKeyAuth(c, s, key, scope)
+			return
+		}
+		if name, identity, isService := clientIdentity(c, s); isService {
+			runClientCertAuth(c, s, name, identity, scope)
+			return
+		}
+		runAuth(c, s)
+	}
+}
+
+func runAPIKeyAuth(c *gin.Context, s *ServerContext, key string, scope string) {
+	owner, apiKey, ok := authenticateAPIKey(c, s, key, scope)
+	if !ok {
+		return
+	}
+	asAdmin := owner.Admin && slices.Contains(apiKey.Scopes, scopeAdmin)
+	if !authorizeTarget(c, s, owner, asAdmin) {
+		return
+	}
+	c.Next()
+}
+
+// authenticateAPIKey checks key is valid and has scope, and returns its owner.
+// On failure it aborts the request.
+func authenticateAPIKey(c *gin.Context, s *ServerContext, key string, scope string) (owner spec.User, apiKey spec.APIKey, ok bool) {
+	defer func() { s.Metrics.authAttempt("apikey", ok) }()
+	id, ok := parseAPIKey(key)
+	if !ok {
+		abortUnauthorized(c)
+		return spec.User{}, spec.APIKey{}, false
+	}
+	apiKey, err := s.db(c).ReadAPIKey(id)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(apiKey.Hash)) != 1 {
+		abortUnauthorized(c)
+		return spec.User{}, spec.APIKey{}, false
+	}
+	if time.Now().After(apiKey.ExpiresAt) {
+		abortUnauthorized(c)
+		return spec.User{}, spec.APIKey{}, false
+	}
+	owner, found := s.Users.lookup(apiKey.Username)
+	if !found {
+		abortUnauthorized(c)
+		return spec.User{}, spec.APIKey{}, false
+	}
+	if !checkStatus(c, owner) {
+		return spec.User{}, spec.APIKey{}, false
+	}
+	if !slices.Contains(apiKey.Scopes, scope) {
+		c.AbortWithError(http.StatusForbidden, errors.New("api key lacks scope "+scope))
+		return spec.User{}, spec.APIKey{}, false
+	}
+	return owner, apiKey, true
+}
+
+func createAPIKey(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	var body APIKeyRequest
+	err := c.BindJSON(&body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	// a key outlives the session, so the caller must prove who they are
+	if !reauthenticate(c, s, s.Users.get(c.GetString(actorKey)), body.CurrentPassword) {
+		return
+	}
+	if body.Name == "" || len(body.Scopes) == 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("api key needs a name and scopes"))
+		return
+	}
+	for _, scope := range body.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			c.AbortWithError(http.StatusBadRequest, errors.New("unknown scope "+scope))
+			return
+		}
+	}
+	for _, scope := range adminOnlyScopes {
+		if slices.Contains(body.Scopes, scope) && !s.Users.get(username).Admin {
+			c.AbortWithError(http.StatusBadRequest, errors.New("only admins can own keys with scope "+scope))
+			return
+		}
+	}
+	lifetime := s.Config.APIKeyTTL
+	if body.ExpiresIn != "" {
+		lifetime, err = time.ParseDuration(body.ExpiresIn)
+		if err != nil || lifetime <= 0 {
+			c.AbortWithError(http.StatusBadRequest, errors.New("expires_in must be a positive duration"))
+			return
+		}
+	}
+	key, id, err := newAPIKey()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now()
+	apiKey := spec.APIKey{
+		ID:        id,
+		Username:  username,
+		Name:      body.Name,
+		Hash:      hashToken(key),
+		Scopes:    body.Scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+	}
+	err = s.db(c).CreateAPIKey(apiKey)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	recordAudit(c, s, auditAPIKeyCreate, username, []spec.FieldChange{{Field: "apikey", After: apiKey.ID}})
+	response := toAPIKeyResponse(apiKey)
+	response.Key = key
+	c.IndentedJSON(http.StatusCreated, response)
+}
+
+func listAPIKeys(c *gin.Context, s *ServerContext) {
+	keys, err := s.db(c).ReadAPIKeys(c.Param("username"))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	responses := []APIKeyResponse{}
+	for _, key := range keys {
+		responses = append(responses, toAPIKeyResponse(key))
+	}
+	c.IndentedJSON(http.StatusOK, responses)
+}
+
+func revokeAPIKey(c *gin.Context, s *ServerContext) {
+	key, err := s.db(c).ReadAPIKey(c.Param("id"))
+	if err != nil || key.Username != c.Param("username") {
+		c.AbortWithError(http.StatusNotFound, errors.New("api key not found"))
+		return
+	}
+	err = s.db(c).DeleteAPIKey(key.ID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	recordAudit(c, s, auditAPIKeyRevoke, key.Username, []spec.FieldChange{{Field: "apikey", Before: key.ID}})
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// Audit actions, named after the resource and what was done to it.
+const (
+	auditUserCreate      = "user.create"
+	auditUserUpdate      = "user.update"
+	auditUserDelete      = "user.delete"
+	auditUserRestore     = "user.restore"
+	auditUserPurge       = "user.purge"
+	auditStatusChange    = "user.status"
+	auditPasswordChange  = "password.change"
+	auditPasswordIssue   = "password.reset_issue"
+	auditPasswordReset   = "password.reset"
+	auditTOTPEnroll      = "totp.enroll"
+	auditTOTPConfirm     = "totp.confirm"
+	auditTOTPDisable     = "totp.disable"
+	auditRecoveryCodes   = "totp.recovery_codes"
+	auditAPIKeyCreate    = "apikey.create"
+	auditAPIKeyRevoke    = "apikey.revoke"
+	auditPasskeyRegister = "passkey.register"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type AuditEntryResponse struct {
+	Time      time.Time          `json:"time"`
+	Actor     string             `json:"actor"`
+	Target    string             `json:"target"`
+	Action    string             `json:"action"`
+	Changes   []spec.FieldChange `json:"changes"`
+	IP        string             `json:"ip"`
+	RequestID string             `json:"request_id"`
+}
+
+func toAuditEntryResponse(entry spec.AuditEntry) AuditEntryResponse {
+	changes := entry.Changes
+	if changes == nil {
+		changes = []spec.FieldChange{}
+	}
+	return AuditEntryResponse{
+		Time:      entry.Time,
+		Actor:     entry.Actor,
+		Target:    entry.Target,
+		Action:    entry.Action,
+		Changes:   changes,
+		IP:        entry.IP,
+		RequestID: entry.RequestID,
+	}
+}
+
+// userChanges lists the fields that differ between before and after. The
+// password is listed without its hashes and the TOTP secret not at all; its
+// enrollment shows as totp_enabled.
+func userChanges(before, after spec.User) []spec.FieldChange {
+	var changes []spec.FieldChange
+	add := func(field string, before, after any) {
+		if before != after {
+			changes = append(changes, spec.FieldChange{Field: field, Before: before, After: after})
+		}
+	}
+	add("name", before.Name, after.Name)
+	add("email", before.Email, after.Email)
+	add("age", before.Age, after.Age)
+	add("admin", before.Admin, after.Admin)
+	add("totp_enabled", before.TOTPEnabled, after.TOTPEnabled)
+	add("status", before.Status, after.Status)
+	add("status_reason", before.StatusReason, after.StatusReason)
+	if before.Hash != after.Hash {
+		changes = append(changes, spec.FieldChange{Field: "password"})
+	}
+	return changes
+}
+
+// recordAudit logs a change the request made to target's account. Requests
+// without an authenticated user, such as signups, are made as the target.
+func recordAudit(c *gin.Context, s *ServerContext, action string, target string, changes []spec.FieldChange) {
+	actor := c.GetString(actorKey)
+	if actor == "" {
+		actor = target
+	}
+	appendAudit(c, s, spec.AuditEntry{
+		Actor:   actor,
+		Target:  target,
+		Action:  action,
+		Changes: changes,
+		IP:      c.ClientIP(),
+	})
+}
+
+// appendAudit stores entry. The change it records has already been made, so a
+// failure is logged rather than failing the request.
+func appendAudit(ctx context.Context, s *ServerContext, entry spec.AuditEntry) {
+	entry.Time = time.Now()
+	entry.RequestID = spec.RequestID(ctx)
+	err := s.db(ctx).AppendAudit(entry)
+	if err != nil {
+		slog.ErrorContext(ctx, "appending audit entry", "action", entry.Action, "target", entry.Target, "error", err)
+	}
+}
+
+// listAudit returns the audit entries of the user given by the username
+// query parameter, or of every user, between since and until (RFC 3339).
+func listAudit(c *gin.Context, s *ServerContext) {
+	query := spec.AuditQuery{Target: c.Query("username")}
+	var err error
+	if since := c.Query("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, errors.New("since is not an RFC 3339 time"))
+			return
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		query.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, errors.New("until is not an RFC 3339 time"))
+			return
+		}
+	}
+	var ok bool
+	query.Limit, ok = queryLimit(c, defaultAuditLimit, maxAuditLimit)
+	if !ok {
+		return
+	}
+	entries, err := s.db(c).ReadAudit(query)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	responses := []AuditEntryResponse{}
+	for _, entry := range entries {
+		responses = append(responses, toAuditEntryResponse(entry))
+	}
+	c.IndentedJSON(http.StatusOK, responses)
+}
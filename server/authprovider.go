@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// errInvalidCredentials is returned by an AuthProvider for unknown users and
+// wrong passwords alike.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// AuthProvider verifies the username and password of a Basic Auth request.
+// Any other error means the provider could not decide, for example because
+// its directory is unreachable.
+type AuthProvider interface {
+	Authenticate(ctx context.Context, s *ServerContext, username string, password string) (spec.User, error)
+}
+
+// localAuthProvider checks passwords against the hashes stored in the database.
+type localAuthProvider struct{}
+
+func (localAuthProvider) Authenticate(ctx context.Context, s *ServerContext, username string, password string) (spec.User, error) {
+	user, found := s.Users.lookup(username)
+	// users provisioned without a password (by SCIM or a directory) cannot log
+	// in locally, nor can directory users that were given one
+	if !found || user.Hash == "" || user.AuthSource != "" {
+		s.Passwords.VerifyDummy(ctx, password)
+		return spec.User{}, errInvalidCredentials
+	}
+	ok, rehash, err := s.Passwords.Verify(ctx, user.Hash, password)
+	if err != nil || !ok {
+		return spec.User{}, errInvalidCredentials
+	}
+	if rehash {
+		rehashPassword(ctx, s, user, password)
+	}
+	return user, nil
+}
+
+// chainAuthProvider asks each provider in turn and accepts the first success.
+type chainAuthProvider []AuthProvider
+
+func (chain chainAuthProvider) Authenticate(ctx context.Context, s *ServerContext, username string, password string) (spec.User, error) {
+	var failure error = errInvalidCredentials
+	for _, provider := range chain {
+		user, err := provider.Authenticate(ctx, s, username, password)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, errInvalidCredentials) {
+			slog.WarnContext(ctx, "auth provider failed", "username", username, "error", err)
+			failure = err
+		}
+	}
+	return spec.User{}, failure
+}
+
+// newAuthProvider builds the provider chain named by config.AuthProviders.
+func newAuthProvider(config Config) (AuthProvider, error) {
+	var chain chainAuthProvider
+	for _, name := range config.AuthProviders {
+		switch name {
+		case "local":
+			chain = append(chain, localAuthProvider{})
+		case "ldap":
+			if config.LDAP.URL == "" {
+				return nil, errors.New("the ldap auth provider needs LDAP_URL")
+			}
+			chain = append(chain, ldapAuthProvider{Config: config.LDAP})
+		default:
+			return nil, errors.New("unknown auth provider " + name)
+		}
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+func parseAuthProviders(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// maxBatchOperations bounds the operations of one batch request.
+const maxBatchOperations = 1000
+
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+// BatchOperation creates, updates or deletes one user. A created user gets the
+// signup status and needs either a password, checked and hashed as on signup,
+// or the password_hash of one from another system in a supported format,
+// which is kept as it is.
+type BatchOperation struct {
+	Op           string        `json:"op"`
+	Username     string        `json:"username"`
+	Password     string        `json:"password,omitempty"`
+	PasswordHash string        `json:"password_hash,omitempty"`
+	User         *UserResponse `json:"user,omitempty"`
+}
+
+type BatchRequest struct {
+	// Atomic runs the operations in one transaction, so either all of them
+	// are made or none is. Otherwise each operation is made on its own.
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchResult is the outcome of the operation at the same index, with the
+// HTTP status the single request would have got.
+type BatchResult struct {
+	Op       string `json:"op"`
+	Username string `json:"username"`
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+type batchError struct {
+	status  int
+	message string
+}
+
+func (e batchError) Error() string {
+	return e.message
+}
+
+// errRolledBack is the result of the operations of an atomic batch that were
+// rolled back or not run because another one failed.
+var errRolledBack = batchError{http.StatusFailedDependency, "not made because another operation failed"}
+
+// runBatch makes the operations of a BatchRequest in order and returns their
+// results. The cache and the audit log are only changed for operations that
+// were committed.
+func runBatch(c *gin.Context, s *ServerContext) {
+	var request BatchRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	operations := request.Operations
+	if len(operations) == 0 || len(operations) > maxBatchOperations {
+		c.AbortWithError(http.StatusBadRequest, errors.New("a batch must have between 1 and "+strconv.Itoa(maxBatchOperations)+" operations"))
+		return
+	}
+	hashes, errs := hashBatchPasswords(c, s, operations)
+	run := func(db spec.DbInterface, i int) (func(), error) {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		return runBatchOperation(c, s, db, operations[i], hashes[i])
+	}
+	commits := make([]func(), len(operations))
+	if request.Atomic {
+		failed := -1
+		err = s.db(c).Transaction(func(tx spec.DbInterface) error {
+			for i := range operations {
+				commits[i], errs[i] = run(tx, i)
+				if errs[i] != nil {
+					failed = i
+					return errs[i]
+				}
+			}
+			return nil
+		})
+		for i := range operations {
+			switch {
+			case err == nil || i == failed:
+			case failed == -1:
+				// the commit failed
+				errs[i] = err
+			default:
+				errs[i] = errRolledBack
+			}
+		}
+	} else {
+		for i := range operations {
+			commits[i], errs[i] = run(s.db(c), i)
+		}
+	}
+	results := make([]BatchResult, len(operations))
+	for i, operation := range operations {
+		if errs[i] == nil {
+			commits[i]()
+		}
+		results[i] = batchResult(c, operation, errs[i])
+	}
+	c.IndentedJSON(http.StatusOK, BatchResponse{Results: results})
+}
+
+func batchResult(ctx context.Context, operation BatchOperation, err error) BatchResult {
+	result := BatchResult{Op: operation.Op, Username: operation.Username, Status: http.StatusOK}
+	var e batchError
+	switch {
+	case err == nil && operation.Op == batchCreate:
+		result.Status = http.StatusCreated
+	case err == nil:
+	case errors.As(err, &e):
+		result.Status = e.status
+		result.Error = e.message
+	case errors.Is(err, spec.ErrVersionConflict):
+		result.Status = http.StatusPreconditionFailed
+		result.Error = err.Error()
+	default:
+		slog.ErrorContext(ctx, "batch operation", "op", operation.Op, "username", operation.Username, "error", err)
+		result.Status = http.StatusInternalServerError
+		result.Error = "internal error"
+	}
+	return result
+}
+
+// hashBatchPasswords checks the passwords of the create operations and
+// hashes them in parallel, since hashing is most of the work of creating a
+// user. An operation whose password cannot be used gets an error instead.
+func hashBatchPasswords(ctx context.Context, s *ServerContext, operations []BatchOperation) ([]string, []error) {
+	hashes := make([]string, len(operations))
+	errs := make([]error, len(operations))
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i, operation := range operations {
+		if operation.Op != batchCreate {
+			continue
+		}
+		switch {
+		case operation.Password != "" && operation.PasswordHash != "":
+			errs[i] = batchError{http.StatusBadRequest, "password and password_hash cannot both be set"}
+		case operation.PasswordHash != "":
+			if err := s.Passwords.Check(operation.PasswordHash); err != nil {
+				errs[i] = batchError{http.StatusBadRequest, err.Error()}
+			}
+			hashes[i] = operation.PasswordHash
+		case operation.Password != "":
+			policyErrs, err := s.Config.PasswordPolicy.Check(operation.Username, operation.Password)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			if len(policyErrs) > 0 {
+				errs[i] = batchError{http.StatusBadRequest, "password " + policyErrs[0].Message}
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				workers <- struct{}{}
+				defer func() { <-workers }()
+				hashes[i], errs[i] = s.Passwords.Hash(ctx, operation.Password)
+			}()
+		default:
+			errs[i] = batchError{http.StatusBadRequest, "password or password_hash is required"}
+		}
+	}
+	wg.Wait()
+	return hashes, errs
+}
+
+// runBatchOperation makes operation in db and returns the changes to the
+// cache and the audit log to make once it is committed.
+func runBatchOperation(c *gin.Context, s *ServerContext, db spec.DbInterface, operation BatchOperation, hash string) (func(), error) {
+	if operation.Username == "" {
+		return nil, batchError{http.StatusBadRequest, "username is required"}
+	}
+	switch operation.Op {
+	case batchCreate:
+		if operation.User == nil || !isUserValid(*operation.User) {
+			return nil, batchError{http.StatusBadRequest, "user data is invalid"}
+		}
+		_, err := db.Read(operation.Username)
+		if err == nil {
+			return nil, batchError{http.StatusConflict, "username already in use"}
+		}
+		_, err = db.ReadDeleted(operation.Username)
+		if err == nil {
+			return nil, batchError{http.StatusConflict, "username already in use"}
+		}
+		user := spec.User{
+			Username:        operation.Username,
+			Hash:            hash,
+			Email:           operation.User.Email,
+			Name:            operation.User.Name,
+			Age:             operation.User.Age,
+			Status:          s.Config.SignupStatus,
+			StatusChangedAt: time.Now(),
+		}
+		err = db.Create(user)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			s.Users.put(user)
+			recordAudit(c, s, auditUserCreate, user.Username, userChanges(spec.User{}, user))
+		}, nil
+	case batchUpdate:
+		if operation.User == nil || !isUserValid(*operation.User) {
+			return nil, batchError{http.StatusBadRequest, "user data is invalid"}
+		}
+		before, err := db.Read(operation.Username)
+		if err != nil {
+			return nil, batchError{http.StatusNotFound, "username not found"}
+		}
+		user := before
+		user.Name = operation.User.Name
+		user.Email = operation.User.Email
+		user.Age = operation.User.Age
+		err = db.UpdateFields(user, profileFields)
+		if err != nil {
+			return nil, err
+		}
+		user.Version++
+		return func() {
+			s.Users.put(user)
+			recordAudit(c, s, auditUserUpdate, user.Username, userChanges(before, user))
+		}, nil
+	case batchDelete:
+		before, err := db.Read(operation.Username)
+		if err != nil {
+			return nil, batchError{http.StatusNotFound, "username not found"}
+		}
+		user, err := softDelete(db, before, "")
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			s.Users.delete(user.Username)
+			recordAudit(c, s, auditUserDelete, user.Username, userChanges(before, user))
+		}, nil
+	}
+	return nil, batchError{http.StatusBadRequest, "unknown op " + strconv.Quote(operation.Op)}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jameshw-dev01/user-api/spec"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SignupConflictPolicy decides how createUser answers when the username is taken.
+type SignupConflictPolicy string
+
+const (
+	// SignupConflictReveal rejects the request with 400 "username already in use".
+	SignupConflictReveal SignupConflictPolicy = "reveal"
+	// SignupConflictConceal answers as if the user had been created, so signup
+	// cannot be used to discover existing usernames. Nothing is stored.
+	SignupConflictConceal SignupConflictPolicy = "conceal"
+)
+
+// RouteRateLimit is the rate limit of one group of routes and the client
+// identity ("ip", "username" or "apikey") its buckets are keyed by.
+type RouteRateLimit struct {
+	Rule RateLimitRule
+	Key  string
+}
+
+type Config struct {
+	SignupConflict SignupConflictPolicy
+	// SignupStatus is the status of new users: "active", or "pending" until an
+	// admin activates them
+	SignupStatus string
+	// SignupRateLimit applies to POST /api/v1/user, which runs bcrypt on every call
+	SignupRateLimit RouteRateLimit
+	// UserRateLimit applies to the authenticated /api/v1/user/:username routes
+	UserRateLimit RouteRateLimit
+	// SessionTTL is how long a token from a password or passkey login is valid
+	SessionTTL time.Duration
+	// PasswordResetTTL is how long a password reset token can be used
+	PasswordResetTTL time.Duration
+	// APIKeyTTL is the lifetime of API keys created without an explicit expiry
+	APIKeyTTL time.Duration
+	// OAuthIssuer is the external base URL of the server, used as the OpenID
+	// Connect issuer and to build the discovery document
+	OAuthIssuer string
+	// OAuthSigningKeyFile is a PEM RSA key to sign tokens with; one is generated if empty
+	OAuthSigningKeyFile string
+	AccessTokenTTL      time.Duration
+	// WebAuthnRPID is the domain passkeys are bound to
+	WebAuthnRPID string
+	// WebAuthnOrigins are the origins browsers may run passkey ceremonies from
+	WebAuthnOrigins []string
+	// PasswordAlgorithm is the hash for new passwords, "bcrypt" or "argon2id".
+	// Stored hashes of another algorithm or parameters are replaced on the
+	// user's next successful login.
+	PasswordAlgorithm string
+	BcryptCost        int
+	// Argon2Memory is in KiB
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+	PasswordPolicy    PasswordPolicy
+	// BreachedPasswordsFile lists SHA-1 hashes of breached passwords, one per line
+	BreachedPasswordsFile string
+	// AuthProviders verify Basic Auth passwords in order: "local" checks the
+	// stored hash and "ldap" binds to the directory in LDAP
+	AuthProviders []string
+	LDAP          LDAPConfig
+	LogLevel      slog.Level
+	// LogFormat is "json" or "text"
+	LogFormat string
+	// MetricsToken, if set, must be sent as a bearer token to read /metrics
+	MetricsToken string
+	// TraceExporter is where spans are sent: "none", "stdout" or "otlp"
+	TraceExporter string
+	// DBConnectTimeout is how long startup keeps retrying an unreachable database
+	DBConnectTimeout time.Duration
+	// ListenAddress is where the HTTP server listens, e.g. ":8080"
+	ListenAddress     string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// ShutdownDelay is how long the server keeps serving after a signal while
+	// /readyz fails, and ShutdownTimeout how long in-flight requests then get
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+	// TLSCertFile and TLSKeyFile turn on HTTPS. The files are reloaded when
+	// they change, checked at most every TLSReloadInterval.
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+	// TLSClientCAFile turns on client certificate authentication
+	TLSClientCAFile      string
+	TLSRequireClientCert bool
+	// ClientIdentities maps the common name, DNS name or URI of a client
+	// certificate to the service account and scopes it is granted
+	ClientIdentities map[string]ClientIdentity
+	// HSTSMaxAge is sent in Strict-Transport-Security on HTTPS responses; 0 turns it off
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	// DeletionGracePeriod is how long a deleted user can be restored before
+	// the purger, run every PurgeInterval, deletes it for good
+	DeletionGracePeriod time.Duration
+	PurgeInterval       time.Duration
+	// LoginHistoryRetention is how long login attempts are kept; the purger
+	// deletes older ones
+	LoginHistoryRetention time.Duration
+	// ExportWait is how long a data export request waits for the archive
+	// before answering 202, and ExportTTL how long the archive is kept after
+	ExportWait time.Duration
+	ExportTTL  time.Duration
+	// IdempotencyTTL is how long the response to a request with an
+	// Idempotency-Key is replayed to retries
+	IdempotencyTTL time.Duration
+	// IdempotencyMaxKeys bounds the stored responses; the purger deletes the
+	// oldest beyond it
+	IdempotencyMaxKeys int
+}
+
+func defaultConfig() Config {
+	return Config{
+		SignupConflict:    SignupConflictReveal,
+		SignupStatus:      spec.StatusActive,
+		SignupRateLimit:   RouteRateLimit{Rule: RateLimitRule{Limit: 10, Period: time.Minute}, Key: "ip"},
+		UserRateLimit:     RouteRateLimit{Rule: RateLimitRule{Limit: 60, Period: time.Minute}, Key: "username"},
+		SessionTTL:        24 * time.Hour,
+		PasswordResetTTL:  time.Hour,
+		APIKeyTTL:         90 * 24 * time.Hour,
+		OAuthIssuer:       "http://localhost:8080",
+		AccessTokenTTL:    time.Hour,
+		WebAuthnRPID:      "localhost",
+		WebAuthnOrigins:   []string{"http://localhost:8080"},
+		PasswordAlgorithm: "bcrypt",
+		BcryptCost:        bcrypt.DefaultCost,
+		Argon2Memory:      64 * 1024,
+		Argon2Iterations:  3,
+		Argon2Parallelism: 2,
+		PasswordPolicy: PasswordPolicy{
+			MinLength:        8,
+			MaxLength:        72,
+			MinClasses:       1,
+			DisallowUsername: true,
+			MinScore:         2,
+		},
+		AuthProviders:         []string{"local"},
+		LogLevel:              slog.LevelInfo,
+		LogFormat:             "json",
+		TraceExporter:         "none",
+		DBConnectTimeout:      5 * time.Minute,
+		ListenAddress:         ":8080",
+		ReadTimeout:           15 * time.Second,
+		ReadHeaderTimeout:     5 * time.Second,
+		WriteTimeout:          30 * time.Second,
+		IdleTimeout:           2 * time.Minute,
+		MaxHeaderBytes:        64 << 10,
+		ShutdownTimeout:       30 * time.Second,
+		TLSReloadInterval:     10 * time.Second,
+		HSTSMaxAge:            365 * 24 * time.Hour,
+		DeletionGracePeriod:   30 * 24 * time.Hour,
+		PurgeInterval:         time.Hour,
+		LoginHistoryRetention: 90 * 24 * time.Hour,
+		ExportWait:            5 * time.Second,
+		ExportTTL:             time.Hour,
+		IdempotencyTTL:        24 * time.Hour,
+		IdempotencyMaxKeys:    100000,
+		LDAP: LDAPConfig{
+			UserFilter:     "(uid=%s)",
+			NameAttribute:  "cn",
+			EmailAttribute: "mail",
+			Provision:      true,
+			Timeout:        5 * time.Second,
+		},
+	}
+}
+
+func (config Config) passwordHasher() PasswordHasher {
+	if config.PasswordAlgorithm == "argon2id" {
+		return argon2idHasher{
+			Memory:      config.Argon2Memory,
+			Iterations:  config.Argon2Iterations,
+			Parallelism: config.Argon2Parallelism,
+			SaltLength:  16,
+			KeyLength:   32,
+		}
+	}
+	return bcryptHasher{Cost: config.BcryptCost}
+}
+
+// loadConfig reads the server configuration from the environment, falling back
+// to defaultConfig for anything unset or unrecognised.
+func loadConfig() Config {
+	config := defaultConfig()
+	switch policy := SignupConflictPolicy(os.Getenv("SIGNUP_CONFLICT_POLICY")); policy {
+	case SignupConflictReveal, SignupConflictConceal:
+		config.SignupConflict = policy
+	}
+	switch status := os.Getenv("SIGNUP_STATUS"); status {
+	case spec.StatusActive, spec.StatusPending:
+		config.SignupStatus = status
+	}
+	loadRouteRateLimit(&config.SignupRateLimit, "RATE_LIMIT_SIGNUP")
+	loadRouteRateLimit(&config.UserRateLimit, "RATE_LIMIT_USER")
+	if ttl, err := time.ParseDuration(os.Getenv("SESSION_TTL")); err == nil && ttl > 0 {
+		config.SessionTTL = ttl
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("PASSWORD_RESET_TTL")); err == nil && ttl > 0 {
+		config.PasswordResetTTL = ttl
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("API_KEY_TTL")); err == nil && ttl > 0 {
+		config.APIKeyTTL = ttl
+	}
+	if issuer := os.Getenv("OAUTH_ISSUER"); issuer != "" {
+		config.OAuthIssuer = strings.TrimSuffix(issuer, "/")
+	}
+	config.OAuthSigningKeyFile = os.Getenv("OAUTH_SIGNING_KEY_FILE")
+	if ttl, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL")); err == nil && ttl > 0 {
+		config.AccessTokenTTL = ttl
+	}
+	if rpID := os.Getenv("WEBAUTHN_RP_ID"); rpID != "" {
+		config.WebAuthnRPID = rpID
+	}
+	if origins := os.Getenv("WEBAUTHN_ORIGINS"); origins != "" {
+		config.WebAuthnOrigins = strings.Split(origins, ",")
+	}
+	switch algorithm := os.Getenv("PASSWORD_HASH"); algorithm {
+	case "bcrypt", "argon2id":
+		config.PasswordAlgorithm = algorithm
+	}
+	if cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil && cost >= bcrypt.MinCost && cost <= bcrypt.MaxCost {
+		config.BcryptCost = cost
+	}
+	if memory, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY"), 10, 32); err == nil && memory > 0 {
+		config.Argon2Memory = uint32(memory)
+	}
+	if iterations, err := strconv.ParseUint(os.Getenv("ARGON2_ITERATIONS"), 10, 32); err == nil && iterations > 0 {
+		config.Argon2Iterations = uint32(iterations)
+	}
+	if parallelism, err := strconv.ParseUint(os.Getenv("ARGON2_PARALLELISM"), 10, 8); err == nil && parallelism > 0 {
+		config.Argon2Parallelism = uint8(parallelism)
+	}
+	loadInt(&config.PasswordPolicy.MinLength, "PASSWORD_MIN_LENGTH")
+	loadInt(&config.PasswordPolicy.MaxLength, "PASSWORD_MAX_LENGTH")
+	loadInt(&config.PasswordPolicy.MinClasses, "PASSWORD_MIN_CLASSES")
+	loadInt(&config.PasswordPolicy.MinScore, "PASSWORD_MIN_SCORE")
+	if allow, err := strconv.ParseBool(os.Getenv("PASSWORD_ALLOW_USERNAME")); err == nil {
+		config.PasswordPolicy.DisallowUsername = !allow
+	}
+	config.BreachedPasswordsFile = os.Getenv("BREACHED_PASSWORDS_FILE")
+	if providers := parseAuthProviders(os.Getenv("AUTH_PROVIDERS")); len(providers) > 0 {
+		config.AuthProviders = providers
+	}
+	config.LDAP.URL = os.Getenv("LDAP_URL")
+	if startTLS, err := strconv.ParseBool(os.Getenv("LDAP_START_TLS")); err == nil {
+		config.LDAP.StartTLS = startTLS
+	}
+	config.LDAP.BindDN = os.Getenv("LDAP_BIND_DN")
+	config.LDAP.BindPassword = os.Getenv("LDAP_BIND_PASSWORD")
+	config.LDAP.BaseDN = os.Getenv("LDAP_BASE_DN")
+	if filter := os.Getenv("LDAP_USER_FILTER"); strings.Count(filter, "%s") == 1 {
+		config.LDAP.UserFilter = filter
+	}
+	if attribute := os.Getenv("LDAP_NAME_ATTRIBUTE"); attribute != "" {
+		config.LDAP.NameAttribute = attribute
+	}
+	if attribute := os.Getenv("LDAP_EMAIL_ATTRIBUTE"); attribute != "" {
+		config.LDAP.EmailAttribute = attribute
+	}
+	if provision, err := strconv.ParseBool(os.Getenv("LDAP_PROVISION")); err == nil {
+		config.LDAP.Provision = provision
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("LDAP_TIMEOUT")); err == nil && timeout > 0 {
+		config.LDAP.Timeout = timeout
+	}
+	var level slog.Level
+	if level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))) == nil {
+		config.LogLevel = level
+	}
+	config.MetricsToken = os.Getenv("METRICS_TOKEN")
+	if address := os.Getenv("LISTEN_ADDR"); address != "" {
+		config.ListenAddress = address
+	} else if port := os.Getenv("PORT"); port != "" {
+		config.ListenAddress = ":" + port
+	}
+	loadDuration(&config.ReadTimeout, "HTTP_READ_TIMEOUT")
+	loadDuration(&config.ReadHeaderTimeout, "HTTP_READ_HEADER_TIMEOUT")
+	loadDuration(&config.WriteTimeout, "HTTP_WRITE_TIMEOUT")
+	loadDuration(&config.IdleTimeout, "HTTP_IDLE_TIMEOUT")
+	loadInt(&config.MaxHeaderBytes, "HTTP_MAX_HEADER_BYTES")
+	loadDuration(&config.ShutdownDelay, "SHUTDOWN_DELAY")
+	loadDuration(&config.ShutdownTimeout, "SHUTDOWN_TIMEOUT")
+	config.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	config.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	loadDuration(&config.TLSReloadInterval, "TLS_RELOAD_INTERVAL")
+	config.TLSClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+	if require, err := strconv.ParseBool(os.Getenv("TLS_REQUIRE_CLIENT_CERT")); err == nil {
+		config.TLSRequireClientCert = require
+	}
+	if identities := os.Getenv("TLS_CLIENT_IDENTITIES"); identities != "" {
+		err := json.Unmarshal([]byte(identities), &config.ClientIdentities)
+		if err != nil {
+			slog.Warn("ignoring invalid client identities", "variable", "TLS_CLIENT_IDENTITIES", "error", err)
+			config.ClientIdentities = nil
+		}
+	}
+	loadDuration(&config.HSTSMaxAge, "HSTS_MAX_AGE")
+	if include, err := strconv.ParseBool(os.Getenv("HSTS_INCLUDE_SUBDOMAINS")); err == nil {
+		config.HSTSIncludeSubdomains = include
+	}
+	loadDuration(&config.DeletionGracePeriod, "DELETION_GRACE_PERIOD")
+	if interval, err := time.ParseDuration(os.Getenv("PURGE_INTERVAL")); err == nil && interval > 0 {
+		config.PurgeInterval = interval
+	}
+	if retention, err := time.ParseDuration(os.Getenv("LOGIN_HISTORY_RETENTION")); err == nil && retention > 0 {
+		config.LoginHistoryRetention = retention
+	}
+	loadDuration(&config.ExportWait, "EXPORT_WAIT")
+	if ttl, err := time.ParseDuration(os.Getenv("EXPORT_TTL")); err == nil && ttl > 0 {
+		config.ExportTTL = ttl
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL")); err == nil && ttl > 0 {
+		config.IdempotencyTTL = ttl
+	}
+	if keys, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_MAX_KEYS")); err == nil && keys > 0 {
+		config.IdempotencyMaxKeys = keys
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("DB_CONNECT_TIMEOUT")); err == nil && timeout >= 0 {
+		config.DBConnectTimeout = timeout
+	}
+	switch exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter {
+	case "none", "stdout", "otlp":
+		config.TraceExporter = exporter
+	case "console":
+		config.TraceExporter = "stdout"
+	}
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "json", "text":
+		config.LogFormat = format
+	}
+	return config
+}
+
+// loadInt overrides value with the non-negative integer in the variable name, if set.
+func loadInt(value *int, name string) {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n >= 0 {
+		*value = n
+	}
+}
+
+// loadDuration overrides value with the non-negative duration in the variable name, if set.
+func loadDuration(value *time.Duration, name string) {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d >= 0 {
+		*value = d
+	}
+}
+
+// loadRouteRateLimit overrides limit from the variables prefix (e.g. "10/1m")
+// and prefix_KEY (e.g. "ip").
+func loadRouteRateLimit(limit *RouteRateLimit, prefix string) {
+	if value := os.Getenv(prefix); value != "" {
+		rule, err := parseRateLimitRule(value)
+		if err != nil {
+			slog.Warn("ignoring invalid rate limit", "variable", prefix, "error", err)
+		} else {
+			limit.Rule = rule
+		}
+	}
+	switch key := os.Getenv(prefix + "_KEY"); key {
+	case "ip", "username", "apikey":
+		limit.Key = key
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// purgeActor is the actor of audit entries for users purged after their grace period.
+const purgeActor = "purger"
+
+// usernameTaken reports whether username belongs to a live user or to a
+// deleted one that can still be restored.
+func usernameTaken(ctx context.Context, s *ServerContext, username string) bool {
+	if _, found := s.Users.lookup(username); found {
+		return true
+	}
+	_, err := s.db(ctx).ReadDeleted(username)
+	return err == nil
+}
+
+// runRestoreAuth lets a deleted user restore their own account by logging in
+// with their old password and second factor. Anyone else must be an admin.
+// Either way the account gets back the status it had before it was deleted,
+// so deleting a suspended account does not lift the suspension.
+func runRestoreAuth(c *gin.Context, s *ServerContext) {
+	username, password, basic := c.Request.BasicAuth()
+	if _, live := s.Users.lookup(username); !basic || live || username != c.Param("username") {
+		runAdminAuth(c, s)
+		return
+	}
+	user, err := s.db(c).ReadDeleted(username)
+	if err != nil || user.Hash == "" {
+		s.Passwords.VerifyDummy(c, password)
+		abortUnauthorized(c)
+		return
+	}
+	ok, _, err := s.Passwords.Verify(c, user.Hash, password)
+	if err != nil || !ok {
+		recordLogin(c, s, username, "password", loginInvalidCredentials)
+		abortUnauthorized(c)
+		return
+	}
+	if !checkSecondFactor(c, s, user) {
+		recordLogin(c, s, username, "password", loginSecondFactorFailed)
+		return
+	}
+	recordLogin(c, s, username, "password", loginSuccess)
+	c.Set(actorKey, username)
+	c.Next()
+}
+
+func restoreUser(c *gin.Context, s *ServerContext) {
+	user, err := s.db(c).ReadDeleted(c.Param("username"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, errors.New("no deleted user with this username"))
+		return
+	}
+	user, err = restoreAccount(c, s, user, previousStatus(user), user.PreviousStatusReason)
+	if errors.Is(err, errRestoreWindowPassed) {
+		c.AbortWithError(http.StatusGone, err)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, UserResponse{Name: user.Name, Email: user.Email, Age: user.Age})
+}
+
+var errRestoreWindowPassed = errors.New("restore window has passed")
+
+// deleteAccount soft-deletes user with the deleted status.
+func deleteAccount(c *gin.Context, s *ServerContext, user spec.User, reason string) error {
+	deleted, err := softDelete(s.db(c), user, reason)
+	if err != nil {
+		return err
+	}
+	s.Users.delete(user.Username)
+	recordAudit(c, s, auditUserDelete, user.Username, userChanges(user, deleted))
+	return nil
+}
+
+// softDelete sets the status of user to deleted and soft-deletes it in db, in
+// one transaction so a user is never left deleted in only one of the two ways.
+// The status it had is kept for restoring it.
+// It returns spec.ErrVersionConflict if the user changed since it was read.
+func softDelete(db spec.DbInterface, user spec.User, reason string) (spec.User, error) {
+	user.PreviousStatus, user.PreviousStatusReason = user.Status, user.StatusReason
+	user = withStatus(user, spec.StatusDeleted, reason)
+	err := db.Transaction(func(tx spec.DbInterface) error {
+		err := tx.UpdateStatus(user)
+		if err != nil {
+			return err
+		}
+		return tx.Delete(user)
+	})
+	if err != nil {
+		return spec.User{}, err
+	}
+	return user, nil
+}
+
+// previousStatus returns the status user had before it was deleted. Users
+// deleted before it was kept were active.
+func previousStatus(user spec.User) string {
+	if user.PreviousStatus == "" {
+		return spec.StatusActive
+	}
+	return user.PreviousStatus
+}
+
+// restoreAccount undoes the soft deletion of user within the grace period and
+// gives it status for reason.
+func restoreAccount(c *gin.Context, s *ServerContext, user spec.User, status string, reason string) (spec.User, error) {
+	if time.Since(user.DeletedAt) > s.Config.DeletionGracePeriod {
+		return spec.User{}, errRestoreWindowPassed
+	}
+	before := user
+	user = withStatus(user, status, reason)
+	user.PreviousStatus, user.PreviousStatusReason = "", ""
+	user.DeletedAt = time.Time{}
+	err := s.db(c).Transaction(func(tx spec.DbInterface) error {
+		err := tx.Restore(user.Username)
+		if err != nil {
+			return err
+		}
+		return tx.UpdateStatus(user)
+	})
+	if err != nil {
+		return spec.User{}, err
+	}
+	user.Version++
+	s.Users.put(user)
+	recordAudit(c, s, auditUserRestore, user.Username, userChanges(before, user))
+	return user, nil
+}
+
+// purgeDeletedUsers runs purgeExpiredUsers every PurgeInterval until ctx is done.
+func purgeDeletedUsers(ctx context.Context, s *ServerContext) {
+	ticker := time.NewTicker(s.Config.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		purgeExpiredUsers(ctx, s)
+		pruneLoginHistory(ctx, s)
+		pruneIdempotencyKeys(ctx, s)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneLoginHistory deletes the login attempts older than the retention period.
+func pruneLoginHistory(ctx context.Context, s *ServerContext) {
+	pruned, err := s.db(ctx).PruneLoginAttempts(time.Now().Add(-s.Config.LoginHistoryRetention))
+	if err != nil {
+		slog.ErrorContext(ctx, "pruning login history", "error", err)
+		return
+	}
+	if pruned > 0 {
+		slog.InfoContext(ctx, "pruned login history", "count", pruned)
+	}
+}
+
+// purgeExpiredUsers deletes for good the users whose grace period has passed.
+func purgeExpiredUsers(ctx context.Context, s *ServerContext) {
+	usernames, err := s.db(ctx).PurgeDeleted(time.Now().Add(-s.Config.DeletionGracePeriod))
+	if err != nil {
+		slog.ErrorContext(ctx, "purging deleted users", "error", err)
+		return
+	}
+	for _, username := range usernames {
+		appendAudit(ctx, s, spec.AuditEntry{Actor: purgeActor, Target: username, Action: auditUserPurge})
+	}
+	if len(usernames) > 0 {
+		slog.InfoContext(ctx, "purged deleted users", "count", len(usernames))
+	}
+}
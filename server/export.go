@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// DataExport is everything stored about a user, for data subject access
+// requests. Password hashes, TOTP secrets and token hashes are left out.
+type DataExport struct {
+	GeneratedAt  time.Time              `json:"generated_at"`
+	Profile      ExportProfile          `json:"profile"`
+	Sessions     []ExportSession        `json:"sessions"`
+	APIKeys      []APIKeyResponse       `json:"api_keys"`
+	Passkeys     []ExportPasskey        `json:"passkeys"`
+	Consents     []ExportConsent        `json:"consents"`
+	LoginHistory []LoginAttemptResponse `json:"login_history"`
+	AuditLog     []AuditEntryResponse   `json:"audit_log"`
+}
+
+type ExportProfile struct {
+	Username    string `json:"username"`
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	Age         uint   `json:"age"`
+	Admin       bool   `json:"admin"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+	// Status is the account status, with the reason and time of its last change
+	Status          string    `json:"status"`
+	StatusReason    string    `json:"status_reason"`
+	StatusChangedAt time.Time `json:"status_changed_at"`
+}
+
+type ExportSession struct {
+	Method    string    `json:"method"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ExportPasskey struct {
+	ID              string    `json:"id"`
+	AttestationType string    `json:"attestation_type"`
+	Transports      []string  `json:"transports"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type ExportConsent struct {
+	ClientID  string    `json:"client_id"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// exportJob is an export being generated in the background. done is closed
+// once archive or err is set.
+type exportJob struct {
+	id       string
+	username string
+	zipped   bool
+	done     chan struct{}
+	archive  []byte
+	err      error
+}
+
+// startExport generates the export of the user in the background and waits up
+// to ExportWait for it, so small accounts get the archive straight away and
+// large ones a 202 with the URL to fetch it from. format=zip zips the JSON.
+// Each user has at most one export kept in memory: while one is pending or
+// ready to fetch, another is refused.
+func startExport(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	job := &exportJob{id: newTokenID(), username: username, zipped: c.Query("format") == "zip", done: make(chan struct{})}
+	if existing, added := s.Exports.add(username, job, s.Config.ExportTTL); !added {
+		c.Header("Location", exportLocation(existing))
+		c.AbortWithError(http.StatusConflict, errors.New("an export is already pending or ready"))
+		return
+	}
+	user := s.Users.get(username)
+	// the *gin.Context is reused once the request ends, so the job only keeps its request ID
+	ctx := spec.WithRequestID(context.Background(), spec.RequestID(c))
+	go func() {
+		job.archive, job.err = generateExport(ctx, s, user, job.zipped)
+		if job.err != nil {
+			slog.ErrorContext(ctx, "generating data export", "username", username, "error", job.err)
+		}
+		close(job.done)
+	}()
+
+	finished := false
+	if s.Config.ExportWait > 0 {
+		timer := time.NewTimer(s.Config.ExportWait)
+		defer timer.Stop()
+		select {
+		case <-job.done:
+			finished = true
+		case <-timer.C:
+		}
+	}
+	if !finished {
+		c.Header("Location", exportLocation(job))
+		c.IndentedJSON(http.StatusAccepted, ExportStatus{ID: job.id, Status: "pending"})
+		return
+	}
+	// the archive is in this response, so it need not be kept
+	s.Exports.take(username)
+	writeExport(c, job)
+}
+
+func exportLocation(job *exportJob) string {
+	return "/api/v1/user/" + job.username + "/export/" + job.id
+}
+
+// getExport returns the archive of an export started by startExport, or 202
+// while it is still being generated.
+func getExport(c *gin.Context, s *ServerContext) {
+	id := c.Param("id")
+	job, found := s.Exports.get(c.Param("username"))
+	if !found || job.id != id {
+		c.AbortWithError(http.StatusNotFound, errors.New("export not found"))
+		return
+	}
+	select {
+	case <-job.done:
+		writeExport(c, job)
+	default:
+		c.IndentedJSON(http.StatusAccepted, ExportStatus{ID: id, Status: "pending"})
+	}
+}
+
+func writeExport(c *gin.Context, job *exportJob) {
+	if job.err != nil {
+		c.AbortWithError(http.StatusInternalServerError, job.err)
+		return
+	}
+	filename, contentType := job.username+"-export.json", "application/json"
+	if job.zipped {
+		filename, contentType = job.username+"-export.zip", "application/zip"
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(http.StatusOK, contentType, job.archive)
+}
+
+// generateExport collects the data of user and encodes it as indented JSON,
+// zipped as <username>.json if zipped is set.
+func generateExport(ctx context.Context, s *ServerContext, user spec.User, zipped bool) ([]byte, error) {
+	export, err := collectExport(s.db(ctx), user)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(export, "", "    ")
+	if err != nil || !zipped {
+		return data, err
+	}
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	file, err := writer.Create(user.Username + ".json")
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return archive.Bytes(), nil
+}
+
+func collectExport(db spec.DbInterface, user spec.User) (DataExport, error) {
+	export := DataExport{
+		GeneratedAt: time.Now(),
+		Profile: ExportProfile{
+			Username:        user.Username,
+			Name:            user.Name,
+			Email:           user.Email,
+			Age:             user.Age,
+			Admin:           user.Admin,
+			TOTPEnabled:     user.TOTPEnabled,
+			Status:          user.Status,
+			StatusReason:    user.StatusReason,
+			StatusChangedAt: user.StatusChangedAt,
+		},
+		Sessions:     []ExportSession{},
+		APIKeys:      []APIKeyResponse{},
+		Passkeys:     []ExportPasskey{},
+		Consents:     []ExportConsent{},
+		LoginHistory: []LoginAttemptResponse{},
+		AuditLog:     []AuditEntryResponse{},
+	}
+	sessions, err := db.ReadSessions(user.Username)
+	if err != nil {
+		return DataExport{}, err
+	}
+	for _, session := range sessions {
+		export.Sessions = append(export.Sessions, ExportSession{
+			Method:    session.Method,
+			CreatedAt: session.CreatedAt,
+			ExpiresAt: session.ExpiresAt,
+		})
+	}
+	keys, err := db.ReadAPIKeys(user.Username)
+	if err != nil {
+		return DataExport{}, err
+	}
+	for _, key := range keys {
+		export.APIKeys = append(export.APIKeys, toAPIKeyResponse(key))
+	}
+	credentials, err := db.ReadCredentials(user.Username)
+	if err != nil {
+		return DataExport{}, err
+	}
+	for _, credential := range credentials {
+		export.Passkeys = append(export.Passkeys, ExportPasskey{
+			ID:              base64.RawURLEncoding.EncodeToString(credential.ID),
+			AttestationType: credential.AttestationType,
+			Transports:      credential.Transports,
+			CreatedAt:       credential.CreatedAt,
+		})
+	}
+	consents, err := db.ReadOAuthConsents(user.Username)
+	if err != nil {
+		return DataExport{}, err
+	}
+	for _, consent := range consents {
+		export.Consents = append(export.Consents, ExportConsent{
+			ClientID:  consent.ClientID,
+			Scopes:    consent.Scopes,
+			CreatedAt: consent.CreatedAt,
+		})
+	}
+	attempts, err := db.ReadLoginAttempts(user.Username, 0)
+	if err != nil {
+		return DataExport{}, err
+	}
+	for _, attempt := range attempts {
+		export.LoginHistory = append(export.LoginHistory, toLoginAttemptResponse(attempt))
+	}
+	entries, err := db.ReadAudit(spec.AuditQuery{Target: user.Username})
+	if err != nil {
+		return DataExport{}, err
+	}
+	for _, entry := range entries {
+		export.AuditLog = append(export.AuditLog, toAuditEntryResponse(entry))
+	}
+	return export, nil
+}
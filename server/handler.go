@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"io"
+	"log/slog"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jameshw-dev01/user-api/spec"
-	"golang.org/x/crypto/bcrypt"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type UserResponse struct {
@@ -28,7 +34,10 @@ func createUser(c *gin.Context, s *ServerContext) {
 		c.AbortWithError(http.StatusBadRequest, errors.New("missing or malformed basic auth header"))
 		return
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if !checkPasswordPolicy(c, s, username, password) {
+		return
+	}
+	hash, err := s.Passwords.Hash(c, password)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -43,49 +52,191 @@ func createUser(c *gin.Context, s *ServerContext) {
 		c.AbortWithError(http.StatusBadRequest, errors.New("user data is invalid"))
 		return
 	}
-	if _, keyFound := s.Users[username]; keyFound {
+	if usernameTaken(c, s, username) {
+		if s.Config.SignupConflict == SignupConflictConceal {
+			c.IndentedJSON(http.StatusCreated, userResponse)
+			return
+		}
 		c.AbortWithError(http.StatusBadRequest, errors.New("username already in use"))
 		return
 	}
 	user := spec.User{
-		Username: username,
-		Hash:     string(hash),
-		Email:    userResponse.Email,
-		Name:     userResponse.Name,
-		Age:      userResponse.Age,
+		Username:        username,
+		Hash:            hash,
+		Email:           userResponse.Email,
+		Name:            userResponse.Name,
+		Age:             userResponse.Age,
+		Status:          s.Config.SignupStatus,
+		StatusChangedAt: time.Now(),
 	}
-	err = s.DB.Create(user)
+	err = s.db(c).Create(user)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 	} else {
-		s.Users[username] = user
+		s.Users.put(user)
+		recordAudit(c, s, auditUserCreate, username, userChanges(spec.User{}, user))
 		c.IndentedJSON(http.StatusCreated, userResponse)
 	}
 }
 
+// abortUnauthorized is the single response for every failed authentication, so
+// callers cannot tell a missing user from a wrong password.
+func abortUnauthorized(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Basic realm="user-api"`)
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+type PasswordChange struct {
+	Password string `json:"password"`
+	// CurrentPassword is required unless the request is made with Basic Auth
+	// or a second factor
+	CurrentPassword string `json:"current_password"`
+}
+
+// checkPasswordPolicy aborts with the policy violations as field errors if
+// password is not acceptable for username.
+func checkPasswordPolicy(c *gin.Context, s *ServerContext, username string, password string) bool {
+	errs, err := s.Config.PasswordPolicy.Check(username, password)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	}
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ValidationErrors{Errors: errs})
+		return false
+	}
+	return true
+}
+
+// runAuth guards routes about the account of a user that admins can also use
+// on any user: its profile and API keys.
 func runAuth(c *gin.Context, s *ServerContext) {
-	requestedUsername := c.Param("username")
-	username, password, ok := c.Request.BasicAuth()
-	if requestedUsername != username {
-		c.AbortWithError(http.StatusBadRequest, errors.New("username and auth do not match"))
+	user, ok := authenticate(c, s)
+	if !ok {
 		return
 	}
-	if s.Users[username].Username == "" {
-		c.AbortWithError(http.StatusNotFound, errors.New("username not found"))
+	if !authorizeTarget(c, s, user, user.Admin) {
 		return
 	}
+	c.Next()
+}
+
+// runSelfAuth guards routes about the credentials, sessions and personal data
+// of a user, which only the user can use, even if the caller is an admin.
+func runSelfAuth(c *gin.Context, s *ServerContext) {
+	user, ok := authenticate(c, s)
 	if !ok {
-		c.AbortWithError(http.StatusBadRequest, errors.New("failed to parse auth header"))
 		return
 	}
-	err := bcrypt.CompareHashAndPassword([]byte(s.Users[username].Hash), []byte(password))
-	if err != nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
+	if !authorizeTarget(c, s, user, false) {
+		return
+	}
+	c.Next()
+}
+
+// runAdminAuth guards routes that are not about a single user and are only
+// open to admins.
+func runAdminAuth(c *gin.Context, s *ServerContext) {
+	user, ok := authenticate(c, s)
+	if !ok {
+		return
+	}
+	c.Set(actorKey, user.Username)
+	if !user.Admin {
+		c.AbortWithError(http.StatusForbidden, errors.New("admin only"))
 		return
 	}
 	c.Next()
 }
 
+// authenticate identifies the user making the request from a session token or
+// Basic Auth and the second factor. On failure it aborts the request.
+func authenticate(c *gin.Context, s *ServerContext) (user spec.User, ok bool) {
+	span, end := startSpan(c, "authenticate")
+	defer func() {
+		span.SetAttributes(attribute.Bool("auth.success", ok))
+		end()
+	}()
+	if _, isAPIKey := apiKeyHeader(c); isAPIKey {
+		c.AbortWithError(http.StatusForbidden, errors.New("api keys cannot be used for this route"))
+		return spec.User{}, false
+	}
+	if token, isBearer := bearerToken(c); isBearer {
+		span.SetAttributes(attribute.String("auth.method", "session"))
+		return authenticateSession(c, s, token)
+	}
+	username, password, basic := c.Request.BasicAuth()
+	if !basic {
+		abortUnauthorized(c)
+		return spec.User{}, false
+	}
+	span.SetAttributes(attribute.String("auth.method", "password"))
+	user, err := s.AuthProvider.Authenticate(c, s, username, password)
+	s.Metrics.authAttempt("password", err == nil)
+	if errors.Is(err, errInvalidCredentials) {
+		if _, exists := s.Users.lookup(username); exists {
+			recordLogin(c, s, username, "password", loginInvalidCredentials)
+		}
+		abortUnauthorized(c)
+		return spec.User{}, false
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusServiceUnavailable, errors.New("authentication provider unavailable"))
+		return spec.User{}, false
+	}
+	if !checkSecondFactor(c, s, user) {
+		recordLogin(c, s, username, "password", loginSecondFactorFailed)
+		return spec.User{}, false
+	}
+	if !checkStatus(c, user) {
+		recordLogin(c, s, username, "password", loginAccountInactive)
+		return spec.User{}, false
+	}
+	recordLogin(c, s, username, "password", loginSuccess)
+	return user, true
+}
+
+// actorKey is the context key of the username a request is authenticated as.
+const actorKey = "actor"
+
+// authorizeTarget records actor as the authenticated user and checks it may act
+// on the :username of the route: its own account, or any existing account if
+// asAdmin is set.
+func authorizeTarget(c *gin.Context, s *ServerContext, actor spec.User, asAdmin bool) bool {
+	c.Set(actorKey, actor.Username)
+	target := c.Param("username")
+	if target == actor.Username {
+		return true
+	}
+	if !asAdmin {
+		c.AbortWithError(http.StatusBadRequest, errors.New("username and auth do not match"))
+		return false
+	}
+	if _, found := s.Users.lookup(target); !found {
+		c.AbortWithError(http.StatusNotFound, errors.New("username not found"))
+		return false
+	}
+	return true
+}
+
+// rehashPassword replaces the stored hash of user with one from the current
+// hasher. Failing to do so does not fail the login; it is retried next time.
+func rehashPassword(ctx context.Context, s *ServerContext, user spec.User, password string) {
+	hash, err := s.Passwords.Hash(ctx, password)
+	if err != nil {
+		slog.ErrorContext(ctx, "rehashing password", "username", user.Username, "error", err)
+		return
+	}
+	user.Hash = hash
+	err = s.db(ctx).Update(user)
+	if err != nil {
+		slog.ErrorContext(ctx, "rehashing password", "username", user.Username, "error", err)
+		return
+	}
+	user.Version++
+	s.Users.put(user)
+}
+
 func updateUser(c *gin.Context, s *ServerContext) {
 	username := c.Param("username")
 	var userResponse UserResponse
@@ -94,48 +245,210 @@ func updateUser(c *gin.Context, s *ServerContext) {
 		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
-	user := spec.User{
-		Username: username,
-		Hash:     s.Users[username].Hash,
-		Email:    userResponse.Email,
-		Name:     userResponse.Name,
-		Age:      userResponse.Age,
+	before := s.Users.get(username)
+	if !checkVersion(c, before) {
+		return
 	}
-	err = s.DB.Update(user)
-	if err != nil {
+	user := before
+	user.Email = userResponse.Email
+	user.Name = userResponse.Name
+	user.Age = userResponse.Age
+	saveProfile(c, s, before, user, profileFields)
+}
+
+// profileFields are the spec.User fields of a UserResponse.
+var profileFields = []string{"Name", "Email", "Age"}
+
+// statusFields are the spec.User fields set by withStatus.
+var statusFields = []string{"Status", "StatusReason", "StatusChangedAt"}
+
+// saveProfile writes the given fields of user, which was before, and responds
+// with the new profile.
+func saveProfile(c *gin.Context, s *ServerContext, before spec.User, user spec.User, fields []string) {
+	err := s.db(c).UpdateFields(user, fields)
+	if errors.Is(err, spec.ErrVersionConflict) {
+		c.AbortWithError(http.StatusPreconditionFailed, err)
+	} else if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 	} else {
-		s.Users[username] = user
-		c.IndentedJSON(http.StatusOK, userResponse)
+		user.Version++
+		s.Users.put(user)
+		recordAudit(c, s, auditUserUpdate, user.Username, userChanges(before, user))
+		c.Header("ETag", versionETag(user))
+		c.IndentedJSON(http.StatusOK, UserResponse{Name: user.Name, Email: user.Email, Age: user.Age})
 	}
 }
 
+func changePassword(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	var body PasswordChange
+	err := c.BindJSON(&body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	user := s.Users.get(username)
+	if !reauthenticate(c, s, user, body.CurrentPassword) {
+		return
+	}
+	if !checkPasswordPolicy(c, s, username, body.Password) {
+		return
+	}
+	user.Hash, err = s.Passwords.Hash(c, body.Password)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	err = s.db(c).Update(user)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	user.Version++
+	s.Users.put(user)
+	// other sessions may have been opened by whoever knew the old password
+	current := ""
+	if token, isBearer := bearerToken(c); isBearer {
+		current = hashToken(token)
+	}
+	err = s.db(c).DeleteSessions(username, current)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	recordAudit(c, s, auditPasswordChange, username, []spec.FieldChange{{Field: "password"}})
+	c.Status(http.StatusNoContent)
+}
+
+// Reauthentication is the optional body of requests that change credentials
+// and take no other fields.
+type Reauthentication struct {
+	CurrentPassword string `json:"current_password"`
+}
+
+// reauthenticateBody is reauthenticate with the current password read from an
+// optional Reauthentication body.
+func reauthenticateBody(c *gin.Context, s *ServerContext, user spec.User) bool {
+	var body Reauthentication
+	if c.Request.Body != nil && c.Request.ContentLength != 0 {
+		err := c.ShouldBindJSON(&body)
+		if err != nil && !errors.Is(err, io.EOF) {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return false
+		}
+	}
+	return reauthenticate(c, s, user, body.CurrentPassword)
+}
+
+// reauthenticate checks that the request proves the user still knows their
+// password, given in currentPassword or just checked from Basic Auth, or has
+// their second factor. A session token alone is not enough to change
+// credentials.
+func reauthenticate(c *gin.Context, s *ServerContext, user spec.User, currentPassword string) bool {
+	if basicUser, _, basic := c.Request.BasicAuth(); basic && basicUser == user.Username && currentPassword == "" {
+		return true
+	}
+	if currentPassword != "" {
+		ok, _, err := s.Passwords.Verify(c, user.Hash, currentPassword)
+		if err != nil || !ok {
+			c.AbortWithError(http.StatusForbidden, errors.New("current password is wrong"))
+			return false
+		}
+		return true
+	}
+	if user.TOTPEnabled {
+		return checkSecondFactor(c, s, user)
+	}
+	c.AbortWithError(http.StatusBadRequest, errors.New("current_password is required"))
+	return false
+}
+
 func getUser(c *gin.Context, s *ServerContext) {
 	username := c.Param("username")
-	user := s.Users[username]
+	user := s.Users.get(username)
 	if user.Username == "" {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	etag := versionETag(user)
+	c.Header("ETag", etag)
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" && weakETagMatch(ifNoneMatch, etag) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
 	userResponse := UserResponse{Name: user.Name, Email: user.Email, Age: user.Age}
 	c.IndentedJSON(http.StatusOK, userResponse)
 }
 
+// versionETag is the entity tag of the user at /api/v1/user/:username. It
+// changes with every Update of the user.
+func versionETag(user spec.User) string {
+	return `"` + strconv.FormatUint(uint64(user.Version), 10) + `"`
+}
+
+// strongETagMatch reports whether an If-Match header is * or lists etag. It is
+// the strong comparison of RFC 9110, under which weak tags match nothing.
+func strongETagMatch(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || (tag == etag && !strings.HasPrefix(tag, "W/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// weakETagMatch reports whether an If-None-Match header is * or lists etag.
+// It is the weak comparison of RFC 9110, under which W/"1" matches "1".
+func weakETagMatch(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersion aborts with 412 if the request has an If-Match header that
+// does not match the current version of user. The write that follows must
+// still check the version, as the user may change in between.
+func checkVersion(c *gin.Context, user spec.User) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" || strongETagMatch(ifMatch, versionETag(user)) {
+		return true
+	}
+	c.AbortWithError(http.StatusPreconditionFailed, errors.New("user has been changed"))
+	return false
+}
+
 func deleteUser(c *gin.Context, s *ServerContext) {
 	username := c.Param("username")
-	user := spec.User{
-		Username: username,
-		Hash:     s.Users[username].Hash,
-		Email:    s.Users[username].Email,
-		Name:     s.Users[username].Name,
-		Age:      s.Users[username].Age,
+	if !checkVersion(c, s.Users.get(username)) {
+		return
 	}
-	err := s.DB.Delete(user)
-	if err != nil {
+	err := deleteAccount(c, s, s.Users.get(username), "")
+	if errors.Is(err, spec.ErrVersionConflict) {
+		c.AbortWithError(http.StatusPreconditionFailed, errors.New("user has been changed"))
+	} else if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 	} else {
-		delete(s.Users, username)
-		c.IndentedJSON(http.StatusOK, s.Users[username])
+		c.IndentedJSON(http.StatusOK, s.Users.get(username))
+	}
+}
+
+// queryLimit returns the limit query parameter, or def if there is none. A
+// limit outside 1 to max aborts the request.
+func queryLimit(c *gin.Context, def int, max int) (int, bool) {
+	param := c.Query("limit")
+	if param == "" {
+		return def, true
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit < 1 || limit > max {
+		c.AbortWithError(http.StatusBadRequest, errors.New("limit must be between 1 and "+strconv.Itoa(max)))
+		return 0, false
 	}
+	return limit, true
 }
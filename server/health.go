@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// readinessTimeout bounds the database checks of one readiness probe.
+const readinessTimeout = 2 * time.Second
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+	// CachedUsers is the number of users in the in-memory cache
+	CachedUsers int `json:"cached_users"`
+}
+
+func toHealthCheck(err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Status: "fail", Error: err.Error()}
+	}
+	return HealthCheck{Status: "ok"}
+}
+
+// healthz reports that the process is alive. It never touches the database,
+// so a database outage does not get the server restarted.
+func healthz(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz reports whether the server can serve traffic: the database answers
+// and its schema is migrated. Until the database is connected and the user
+// cache loaded, the startup handler answers instead and reports not ready.
+func readyz(c *gin.Context, s *ServerContext) {
+	ctx, cancel := context.WithTimeout(c, readinessTimeout)
+	defer cancel()
+	db := s.db(ctx)
+	response := ReadinessResponse{
+		Status:      "ok",
+		Checks:      map[string]HealthCheck{},
+		CachedUsers: s.Users.len(),
+	}
+	response.Checks["database"] = toHealthCheck(db.Ping())
+	if response.Checks["database"].Status == "ok" {
+		response.Checks["migrations"] = toHealthCheck(db.CheckMigrations())
+	} else {
+		response.Checks["migrations"] = HealthCheck{Status: "fail", Error: "database unavailable"}
+	}
+	response.Checks["cache"] = HealthCheck{Status: "ok"}
+	response.Checks["shutdown"] = HealthCheck{Status: "ok"}
+	if s.Draining.Load() {
+		response.Checks["shutdown"] = HealthCheck{Status: "fail", Error: "shutting down"}
+	}
+	status := http.StatusOK
+	for _, check := range response.Checks {
+		if check.Status != "ok" {
+			response.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	c.IndentedJSON(status, response)
+}
+
+// startupHandler serves while the server connects to the database and loads
+// the user cache, so liveness probes pass and readiness probes fail instead
+// of the port being closed. Every other request gets 503. Once ready is
+// called it hands all requests to the router.
+type startupHandler struct {
+	startup *gin.Engine
+	router  atomic.Pointer[gin.Engine]
+}
+
+func newStartupHandler() *startupHandler {
+	h := startupHandler{startup: gin.New()}
+	h.startup.Use(recovery())
+	h.startup.GET("/healthz", healthz)
+	h.startup.GET("/readyz", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusServiceUnavailable, ReadinessResponse{
+			Status: "unavailable",
+			Checks: map[string]HealthCheck{
+				"database": {Status: "fail", Error: "connecting"},
+				"cache":    {Status: "fail", Error: "user cache not loaded"},
+			},
+		})
+	})
+	h.startup.NoRoute(func(c *gin.Context) {
+		c.Header("Retry-After", "1")
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+	})
+	return &h
+}
+
+func (h *startupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if router := h.router.Load(); router != nil {
+		router.ServeHTTP(w, r)
+		return
+	}
+	h.startup.ServeHTTP(w, r)
+}
+
+// ready switches every following request over to router.
+func (h *startupHandler) ready(router *gin.Engine) {
+	h.router.Store(router)
+}
+
+// connectWithRetry calls connect until it succeeds, waiting backoff after the
+// first failure and doubling the wait up to maxBackoff after each further
+// one. It gives up once timeout has passed or ctx is done.
+func connectWithRetry(ctx context.Context, connect func() (spec.DbInterface, error), timeout time.Duration, backoff time.Duration) (spec.DbInterface, error) {
+	const maxBackoff = 30 * time.Second
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		db, err := connect()
+		if err == nil {
+			return db, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("giving up on the database after %d attempts: %w", attempt, err)
+		}
+		slog.Warn("database unavailable, retrying", "attempt", attempt, "retry_in", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("giving up on the database after %d attempts: %w", attempt, ctx.Err())
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
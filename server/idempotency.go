@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+const (
+	// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentResponseSize bounds the stored responses; larger ones are
+	// not kept, so retries of them run again
+	maxIdempotentResponseSize = 64 << 10
+	// idempotencyClaimTTL is how long a running request holds its key, so a
+	// replica that dies mid-request does not block retries until IdempotencyTTL
+	idempotencyClaimTTL = time.Minute
+)
+
+// idempotencySecret derives the key of the request fingerprints, which cover
+// the password, from the signing key, so replicas sharing
+// OAUTH_SIGNING_KEY_FILE compute the same fingerprints.
+func idempotencySecret(key SigningKey) []byte {
+	mac := hmac.New(sha256.New, key.Key.D.Bytes())
+	mac.Write([]byte("idempotency fingerprint"))
+	return mac.Sum(nil)
+}
+
+// idempotencyFingerprint identifies the credentials and body of a request.
+func idempotencyFingerprint(c *gin.Context, s *ServerContext, body []byte) []byte {
+	mac := hmac.New(sha256.New, s.IdempotencySecret)
+	mac.Write([]byte(c.GetHeader("Authorization")))
+	mac.Write([]byte{0})
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// recordingWriter keeps a copy of the response body.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent makes requests with an Idempotency-Key header safe to retry: the
+// response to the first one is stored in the database for IdempotencyTTL and
+// replayed to later requests with the same key, which must have the same
+// credentials and body. Requests that fail with a server error are not
+// stored, so they can be retried.
+func idempotent(s *ServerContext) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithError(http.StatusBadRequest, errors.New("idempotency key is too long"))
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		// usernames cannot contain a colon, so the key is unambiguous
+		username, _, _ := c.Request.BasicAuth()
+		response := spec.IdempotentResponse{
+			Key:         username + ":" + key,
+			Fingerprint: idempotencyFingerprint(c, s, body),
+			ExpiresAt:   time.Now().Add(idempotencyClaimTTL),
+		}
+		first, claimed, err := s.db(c).ClaimIdempotencyKey(response)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if !claimed {
+			replayIdempotent(c, first, response.Fingerprint)
+			return
+		}
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		defer func() {
+			c.Writer = writer.ResponseWriter
+			// the response is stored even if the client has gone away
+			db := s.db(context.WithoutCancel(c))
+			var err error
+			// nothing is written if the handler panicked
+			if !writer.Written() || writer.Status() >= http.StatusInternalServerError || writer.body.Len() > maxIdempotentResponseSize {
+				err = db.DeleteIdempotencyKey(response.Key)
+			} else {
+				response.Status = writer.Status()
+				response.ContentType = writer.Header().Get("Content-Type")
+				response.Body = writer.body.Bytes()
+				response.ExpiresAt = time.Now().Add(s.Config.IdempotencyTTL)
+				err = db.CompleteIdempotencyKey(response)
+			}
+			if err != nil {
+				slog.ErrorContext(c, "storing idempotent response", "error", err)
+			}
+		}()
+		c.Next()
+	}
+}
+
+// pruneIdempotencyKeys deletes the expired idempotent responses and the
+// oldest ones beyond IdempotencyMaxKeys.
+func pruneIdempotencyKeys(ctx context.Context, s *ServerContext) {
+	pruned, err := s.db(ctx).PruneIdempotencyKeys(time.Now(), s.Config.IdempotencyMaxKeys)
+	if err != nil {
+		slog.ErrorContext(ctx, "pruning idempotency keys", "error", err)
+		return
+	}
+	if pruned > 0 {
+		slog.InfoContext(ctx, "pruned idempotency keys", "count", pruned)
+	}
+}
+
+// replayIdempotent answers a retry of first with its response.
+func replayIdempotent(c *gin.Context, first spec.IdempotentResponse, fingerprint []byte) {
+	if !hmac.Equal(first.Fingerprint, fingerprint) {
+		c.AbortWithError(http.StatusUnprocessableEntity, errors.New("idempotency key was used for a different request"))
+		return
+	}
+	if first.Status == 0 {
+		c.AbortWithError(http.StatusConflict, errors.New("a request with this idempotency key is in progress"))
+		return
+	}
+	c.Header("Idempotent-Replayed", "true")
+	if first.ContentType == "" {
+		c.AbortWithStatus(first.Status)
+		return
+	}
+	c.Data(first.Status, first.ContentType, first.Body)
+	c.Abort()
+}
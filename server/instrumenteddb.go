@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jameshw-dev01/user-api/spec"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentedDB traces each DbInterface operation and records its latency
+// and errors.
+type instrumentedDB struct {
+	next    spec.DbInterface
+	metrics *Metrics
+	ctx     context.Context
+}
+
+func (m *Metrics) instrumentDB(db spec.DbInterface) spec.DbInterface {
+	return instrumentedDB{next: db, metrics: m, ctx: context.Background()}
+}
+
+type dbOperation struct {
+	name  string
+	start time.Time
+	span  trace.Span
+}
+
+func (d instrumentedDB) begin(name string) dbOperation {
+	_, span := tracer.Start(d.ctx, "db."+name, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBOperationName(name)))
+	return dbOperation{name: name, start: time.Now(), span: span}
+}
+
+func (d instrumentedDB) observe(operation dbOperation, err *error) {
+	d.metrics.dbDuration.WithLabelValues(operation.name).Observe(time.Since(operation.start).Seconds())
+	if *err != nil {
+		d.metrics.dbErrors.WithLabelValues(operation.name).Inc()
+		operation.span.RecordError(*err)
+		operation.span.SetStatus(codes.Error, (*err).Error())
+	}
+	operation.span.End()
+}
+
+func (d instrumentedDB) WithContext(ctx context.Context) spec.DbInterface {
+	return instrumentedDB{next: d.next.WithContext(ctx), metrics: d.metrics, ctx: ctx}
+}
+
+func (d instrumentedDB) Transaction(fn func(tx spec.DbInterface) error) (err error) {
+	defer d.observe(d.begin("Transaction"), &err)
+	return d.next.Transaction(func(tx spec.DbInterface) error {
+		return fn(instrumentedDB{next: tx, metrics: d.metrics, ctx: d.ctx})
+	})
+}
+
+func (d instrumentedDB) UseTOTPStep(username string, step int64) (fresh bool, err error) {
+	defer d.observe(d.begin("UseTOTPStep"), &err)
+	return d.next.UseTOTPStep(username, step)
+}
+
+func (d instrumentedDB) DeleteSessions(username string, exceptTokenHash string) (err error) {
+	defer d.observe(d.begin("DeleteSessions"), &err)
+	return d.next.DeleteSessions(username, exceptTokenHash)
+}
+
+func (d instrumentedDB) CreatePasswordReset(reset spec.PasswordReset) (err error) {
+	defer d.observe(d.begin("CreatePasswordReset"), &err)
+	return d.next.CreatePasswordReset(reset)
+}
+
+func (d instrumentedDB) ConsumePasswordReset(tokenHash string) (reset spec.PasswordReset, err error) {
+	defer d.observe(d.begin("ConsumePasswordReset"), &err)
+	return d.next.ConsumePasswordReset(tokenHash)
+}
+
+func (d instrumentedDB) Ping() (err error) {
+	defer d.observe(d.begin("Ping"), &err)
+	return d.next.Ping()
+}
+
+func (d instrumentedDB) CheckMigrations() (err error) {
+	defer d.observe(d.begin("CheckMigrations"), &err)
+	return d.next.CheckMigrations()
+}
+
+func (d instrumentedDB) Close() error {
+	return d.next.Close()
+}
+
+func (d instrumentedDB) Create(user spec.User) (err error) {
+	defer d.observe(d.begin("Create"), &err)
+	return d.next.Create(user)
+}
+
+func (d instrumentedDB) ReadAll() (users []spec.User, err error) {
+	defer d.observe(d.begin("ReadAll"), &err)
+	return d.next.ReadAll()
+}
+
+func (d instrumentedDB) Read(username string) (user spec.User, err error) {
+	defer d.observe(d.begin("Read"), &err)
+	return d.next.Read(username)
+}
+
+func (d instrumentedDB) Update(user spec.User) (err error) {
+	defer d.observe(d.begin("Update"), &err)
+	return d.next.Update(user)
+}
+
+func (d instrumentedDB) UpdateFields(user spec.User, fields []string) (err error) {
+	defer d.observe(d.begin("UpdateFields"), &err)
+	return d.next.UpdateFields(user, fields)
+}
+
+func (d instrumentedDB) Delete(user spec.User) (err error) {
+	defer d.observe(d.begin("Delete"), &err)
+	return d.next.Delete(user)
+}
+
+func (d instrumentedDB) UpdateStatus(user spec.User) (err error) {
+	defer d.observe(d.begin("UpdateStatus"), &err)
+	return d.next.UpdateStatus(user)
+}
+
+func (d instrumentedDB) ReadDeleted(username string) (user spec.User, err error) {
+	defer d.observe(d.begin("ReadDeleted"), &err)
+	return d.next.ReadDeleted(username)
+}
+
+func (d instrumentedDB) Restore(username string) (err error) {
+	defer d.observe(d.begin("Restore"), &err)
+	return d.next.Restore(username)
+}
+
+func (d instrumentedDB) PurgeDeleted(cutoff time.Time) (usernames []string, err error) {
+	defer d.observe(d.begin("PurgeDeleted"), &err)
+	return d.next.PurgeDeleted(cutoff)
+}
+
+func (d instrumentedDB) UpdateTOTP(user spec.User) (err error) {
+	defer d.observe(d.begin("UpdateTOTP"), &err)
+	return d.next.UpdateTOTP(user)
+}
+
+func (d instrumentedDB) ReplaceRecoveryCodes(username string, hashes []string) (err error) {
+	defer d.observe(d.begin("ReplaceRecoveryCodes"), &err)
+	return d.next.ReplaceRecoveryCodes(username, hashes)
+}
+
+func (d instrumentedDB) ConsumeRecoveryCode(username string, hash string) (used bool, err error) {
+	defer d.observe(d.begin("ConsumeRecoveryCode"), &err)
+	return d.next.ConsumeRecoveryCode(username, hash)
+}
+
+func (d instrumentedDB) CreateCredential(credential spec.Credential) (err error) {
+	defer d.observe(d.begin("CreateCredential"), &err)
+	return d.next.CreateCredential(credential)
+}
+
+func (d instrumentedDB) ReadCredentials(username string) (credentials []spec.Credential, err error) {
+	defer d.observe(d.begin("ReadCredentials"), &err)
+	return d.next.ReadCredentials(username)
+}
+
+func (d instrumentedDB) UpdateCredential(credential spec.Credential) (err error) {
+	defer d.observe(d.begin("UpdateCredential"), &err)
+	return d.next.UpdateCredential(credential)
+}
+
+func (d instrumentedDB) CreateSession(session spec.Session) (err error) {
+	defer d.observe(d.begin("CreateSession"), &err)
+	return d.next.CreateSession(session)
+}
+
+func (d instrumentedDB) ReadSession(tokenHash string) (session spec.Session, err error) {
+	defer d.observe(d.begin("ReadSession"), &err)
+	return d.next.ReadSession(tokenHash)
+}
+
+func (d instrumentedDB) ReadSessions(username string) (sessions []spec.Session, err error) {
+	defer d.observe(d.begin("ReadSessions"), &err)
+	return d.next.ReadSessions(username)
+}
+
+func (d instrumentedDB) DeleteSession(tokenHash string) (err error) {
+	defer d.observe(d.begin("DeleteSession"), &err)
+	return d.next.DeleteSession(tokenHash)
+}
+
+func (d instrumentedDB) CreateAPIKey(key spec.APIKey) (err error) {
+	defer d.observe(d.begin("CreateAPIKey"), &err)
+	return d.next.CreateAPIKey(key)
+}
+
+func (d instrumentedDB) ReadAPIKey(id string) (key spec.APIKey, err error) {
+	defer d.observe(d.begin("ReadAPIKey"), &err)
+	return d.next.ReadAPIKey(id)
+}
+
+func (d instrumentedDB) ReadAPIKeys(username string) (keys []spec.APIKey, err error) {
+	defer d.observe(d.begin("ReadAPIKeys"), &err)
+	return d.next.ReadAPIKeys(username)
+}
+
+func (d instrumentedDB) DeleteAPIKey(id string) (err error) {
+	defer d.observe(d.begin("DeleteAPIKey"), &err)
+	return d.next.DeleteAPIKey(id)
+}
+
+func (d instrumentedDB) CreateOAuthClient(client spec.OAuthClient) (err error) {
+	defer d.observe(d.begin("CreateOAuthClient"), &err)
+	return d.next.CreateOAuthClient(client)
+}
+
+func (d instrumentedDB) ReadOAuthClient(id string) (client spec.OAuthClient, err error) {
+	defer d.observe(d.begin("ReadOAuthClient"), &err)
+	return d.next.ReadOAuthClient(id)
+}
+
+func (d instrumentedDB) SaveOAuthConsent(consent spec.OAuthConsent) (err error) {
+	defer d.observe(d.begin("SaveOAuthConsent"), &err)
+	return d.next.SaveOAuthConsent(consent)
+}
+
+func (d instrumentedDB) ReadOAuthConsent(username string, clientID string) (consent spec.OAuthConsent, err error) {
+	defer d.observe(d.begin("ReadOAuthConsent"), &err)
+	return d.next.ReadOAuthConsent(username, clientID)
+}
+
+func (d instrumentedDB) AppendAudit(entry spec.AuditEntry) (err error) {
+	defer d.observe(d.begin("AppendAudit"), &err)
+	return d.next.AppendAudit(entry)
+}
+
+func (d instrumentedDB) ReadAudit(query spec.AuditQuery) (entries []spec.AuditEntry, err error) {
+	defer d.observe(d.begin("ReadAudit"), &err)
+	return d.next.ReadAudit(query)
+}
+
+func (d instrumentedDB) CreateLoginAttempt(attempt spec.LoginAttempt) (err error) {
+	defer d.observe(d.begin("CreateLoginAttempt"), &err)
+	return d.next.CreateLoginAttempt(attempt)
+}
+
+func (d instrumentedDB) ReadLoginAttempts(username string, limit int) (attempts []spec.LoginAttempt, err error) {
+	defer d.observe(d.begin("ReadLoginAttempts"), &err)
+	return d.next.ReadLoginAttempts(username, limit)
+}
+
+func (d instrumentedDB) PruneLoginAttempts(cutoff time.Time) (pruned int64, err error) {
+	defer d.observe(d.begin("PruneLoginAttempts"), &err)
+	return d.next.PruneLoginAttempts(cutoff)
+}
+
+func (d instrumentedDB) ReadOAuthConsents(username string) (consents []spec.OAuthConsent, err error) {
+	defer d.observe(d.begin("ReadOAuthConsents"), &err)
+	return d.next.ReadOAuthConsents(username)
+}
+
+func (d instrumentedDB) ClaimIdempotencyKey(response spec.IdempotentResponse) (first spec.IdempotentResponse, claimed bool, err error) {
+	defer d.observe(d.begin("ClaimIdempotencyKey"), &err)
+	return d.next.ClaimIdempotencyKey(response)
+}
+
+func (d instrumentedDB) CompleteIdempotencyKey(response spec.IdempotentResponse) (err error) {
+	defer d.observe(d.begin("CompleteIdempotencyKey"), &err)
+	return d.next.CompleteIdempotencyKey(response)
+}
+
+func (d instrumentedDB) DeleteIdempotencyKey(key string) (err error) {
+	defer d.observe(d.begin("DeleteIdempotencyKey"), &err)
+	return d.next.DeleteIdempotencyKey(key)
+}
+
+func (d instrumentedDB) PruneIdempotencyKeys(cutoff time.Time, keep int) (pruned int64, err error) {
+	defer d.observe(d.begin("PruneIdempotencyKeys"), &err)
+	return d.next.PruneIdempotencyKeys(cutoff, keep)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+type LDAPConfig struct {
+	// URL is the directory server, e.g. ldaps://ldap.example.com
+	URL string
+	// StartTLS upgrades an ldap:// connection before binding
+	StartTLS bool
+	// BindDN and BindPassword are the service account used to look users up;
+	// the search is anonymous if BindDN is empty
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds a user's entry, with %s replaced by the escaped username
+	UserFilter     string
+	NameAttribute  string
+	EmailAttribute string
+	// Provision creates a local user the first time someone from the directory
+	// logs in; otherwise only users that already exist locally may log in
+	Provision bool
+	Timeout   time.Duration
+}
+
+// ldapAuthProvider verifies passwords by binding to a directory as the user.
+type ldapAuthProvider struct {
+	Config LDAPConfig
+}
+
+func (p ldapAuthProvider) Authenticate(ctx context.Context, s *ServerContext, username string, password string) (spec.User, error) {
+	// an empty password would be an unauthenticated bind, which most servers accept
+	if username == "" || password == "" {
+		return spec.User{}, errInvalidCredentials
+	}
+	ctx, span := tracer.Start(ctx, "ldap.authenticate")
+	defer span.End()
+	conn, err := p.dial()
+	if err != nil {
+		return spec.User{}, err
+	}
+	defer conn.Close()
+
+	if p.Config.BindDN != "" {
+		err = conn.Bind(p.Config.BindDN, p.Config.BindPassword)
+		if err != nil {
+			return spec.User{}, fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		p.Config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(p.Config.Timeout.Seconds()), false,
+		fmt.Sprintf(p.Config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{p.Config.NameAttribute, p.Config.EmailAttribute}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return spec.User{}, fmt.Errorf("ldap search: %w", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		s.Passwords.VerifyDummy(ctx, password)
+		return spec.User{}, errInvalidCredentials
+	}
+	entry := result.Entries[0]
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return spec.User{}, errInvalidCredentials
+	}
+	if err != nil {
+		return spec.User{}, fmt.Errorf("ldap bind: %w", err)
+	}
+	return p.localUser(ctx, s, username, entry)
+}
+
+func (p ldapAuthProvider) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(p.Config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: p.Config.Timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(p.Config.Timeout)
+	if p.Config.StartTLS {
+		u, err := url.Parse(p.Config.URL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// localUser returns the local user for a directory entry, creating it just in
+// time if provisioning is on. Provisioned users have no local password. A
+// local account that the directory does not own is never matched, so a
+// directory entry cannot take over an account of the same name.
+func (p ldapAuthProvider) localUser(ctx context.Context, s *ServerContext, username string, entry *ldap.Entry) (spec.User, error) {
+	if user, found := s.Users.lookup(username); found {
+		if user.AuthSource != spec.AuthSourceLDAP {
+			return spec.User{}, errInvalidCredentials
+		}
+		return user, nil
+	}
+	if !p.Config.Provision || usernameTaken(ctx, s, username) {
+		return spec.User{}, errInvalidCredentials
+	}
+	user := spec.User{
+		Username:        username,
+		AuthSource:      spec.AuthSourceLDAP,
+		Name:            entry.GetAttributeValue(p.Config.NameAttribute),
+		Email:           entry.GetAttributeValue(p.Config.EmailAttribute),
+		Status:          spec.StatusActive,
+		StatusChangedAt: time.Now(),
+	}
+	if user.Name == "" {
+		user.Name = username
+	}
+	if user.Email == "" {
+		return spec.User{}, errors.New("directory entry " + entry.DN + " has no " + p.Config.EmailAttribute)
+	}
+	err := s.db(ctx).Create(user)
+	if err != nil {
+		return spec.User{}, err
+	}
+	s.Users.put(user)
+	appendAudit(ctx, s, spec.AuditEntry{
+		Actor:   username,
+		Target:  username,
+		Action:  auditUserCreate,
+		Changes: userChanges(spec.User{}, user),
+	})
+	return user, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jameshw-dev01/user-api/database"
+	"github.com/jameshw-dev01/user-api/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+type directoryEntry struct {
+	password   string
+	attributes map[string]string
+}
+
+// fakeDirectory is an in-process LDAP server that understands simple binds and
+// searches with an equality filter on uid.
+type fakeDirectory struct {
+	listener net.Listener
+	entries  map[string]directoryEntry
+}
+
+func newFakeDirectory(t *testing.T, entries map[string]directoryEntry) *fakeDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := &fakeDirectory{listener: listener, entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go directory.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return directory
+}
+
+func (d *fakeDirectory) URL() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		id := request.Children[0].Value.(int64)
+		op := request.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if entry, found := d.entries[dn]; found && entry.password == password {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapResponse(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for dn, entry := range d.entries {
+				if filter != "(uid="+entry.attributes["uid"]+")" {
+					continue
+				}
+				result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, value := range entry.attributes {
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+					attribute.AppendChild(values)
+					attributes.AppendChild(attribute)
+				}
+				result.AppendChild(attributes)
+				conn.Write(ldapMessage(id, result).Bytes())
+			}
+			conn.Write(ldapResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	return message
+}
+
+func ldapResponse(id int64, tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapMessage(id, op)
+}
+
+func TestLDAPAuthProvider(t *testing.T) {
+	directory := newFakeDirectory(t, map[string]directoryEntry{
+		"cn=service,dc=example,dc=com": {password: "service-secret"},
+		"uid=alice,ou=people,dc=example,dc=com": {
+			password:   "directory-Secret-3",
+			attributes: map[string]string{"uid": "alice", "cn": "Alice Liddell", "mail": "alice@example.com"},
+		},
+		"uid=john_doe,ou=people,dc=example,dc=com": {
+			password:   "directory-Secret-4",
+			attributes: map[string]string{"uid": "john_doe", "cn": "John Directory", "mail": "john@example.com"},
+		},
+	})
+	t.Setenv("AUTH_PROVIDERS", "local,ldap")
+	t.Setenv("LDAP_URL", directory.URL())
+	t.Setenv("LDAP_BIND_DN", "cn=service,dc=example,dc=com")
+	t.Setenv("LDAP_BIND_PASSWORD", "service-secret")
+	t.Setenv("LDAP_BASE_DN", "dc=example,dc=com")
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/user/alice", nil)
+	req.SetBasicAuth("alice", "wrong-password")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	_, found := s.Users.lookup("alice")
+	assert.False(t, found)
+
+	// the first successful login creates the user from the directory entry
+	w = httptest.NewRecorder()
+	req.SetBasicAuth("alice", "directory-Secret-3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var retrievedUser UserResponse
+	json.Unmarshal(w.Body.Bytes(), &retrievedUser)
+	assert.Equal(t, UserResponse{Name: "Alice Liddell", Email: "alice@example.com"}, retrievedUser)
+	assert.Empty(t, s.Users.get("alice").Hash)
+	assert.Equal(t, spec.AuthSourceLDAP, s.Users.get("alice").AuthSource)
+
+	// local users still log in with their own password
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// but a directory entry of the same name cannot log in as them
+	w = httptest.NewRecorder()
+	req.SetBasicAuth("john_doe", "directory-Secret-4")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLDAPAuthProviderUnavailable(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	listener.Close()
+	config := defaultConfig().LDAP
+	config.URL = "ldap://" + listener.Addr().String()
+	_, err := ldapAuthProvider{Config: config}.Authenticate(context.Background(), nil, "alice", "directory-Secret-3")
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, errInvalidCredentials)
+
+	_, err = ldapAuthProvider{Config: config}.Authenticate(context.Background(), nil, "alice", "")
+	assert.ErrorIs(t, err, errInvalidCredentials)
+}
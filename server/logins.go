@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// Login outcomes other than success say why the attempt failed.
+const (
+	loginSuccess             = "success"
+	loginInvalidCredentials  = "invalid_credentials"
+	loginSecondFactorFailed  = "second_factor_failed"
+	loginClonedAuthenticator = "cloned_authenticator"
+	loginAccountInactive     = "account_inactive"
+)
+
+const (
+	defaultLoginsLimit = 50
+	maxLoginsLimit     = 500
+)
+
+type LoginAttemptResponse struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Method    string    `json:"method"`
+	Outcome   string    `json:"outcome"`
+}
+
+// recordLogin adds an attempt to log in as username to its login history:
+// every successful Basic Auth authentication, including the one creating a
+// session, passkey logins, restores, and failed attempts on an existing
+// account. A failure to record is logged and does not change the outcome of
+// the login.
+func recordLogin(c *gin.Context, s *ServerContext, username string, method string, outcome string) {
+	err := s.db(c).CreateLoginAttempt(spec.LoginAttempt{
+		Username:  username,
+		Time:      time.Now(),
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Method:    method,
+		Outcome:   outcome,
+	})
+	if err != nil {
+		slog.ErrorContext(c, "recording login attempt", "username", username, "error", err)
+	}
+}
+
+func listLogins(c *gin.Context, s *ServerContext) {
+	limit, ok := queryLimit(c, defaultLoginsLimit, maxLoginsLimit)
+	if !ok {
+		return
+	}
+	attempts, err := s.db(c).ReadLoginAttempts(c.Param("username"), limit)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	responses := []LoginAttemptResponse{}
+	for _, attempt := range attempts {
+		responses = append(responses, toLoginAttemptResponse(attempt))
+	}
+	c.IndentedJSON(http.StatusOK, responses)
+}
+
+func toLoginAttemptResponse(attempt spec.LoginAttempt) LoginAttemptResponse {
+	return LoginAttemptResponse{
+		Time:      attempt.Time,
+		IP:        attempt.IP,
+		UserAgent: attempt.UserAgent,
+		Method:    attempt.Method,
+		Outcome:   attempt.Outcome,
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors of one server. Each server has its
+// own registry so several can run in one process, as they do in the tests.
+type Metrics struct {
+	Registry        *prometheus.Registry
+	httpRequests    *prometheus.CounterVec
+	httpDuration    *prometheus.HistogramVec
+	dbDuration      *prometheus.HistogramVec
+	dbErrors        *prometheus.CounterVec
+	authAttempts    *prometheus.CounterVec
+	passwordHashing *prometheus.HistogramVec
+}
+
+func newMetrics(s *ServerContext) *Metrics {
+	m := Metrics{
+		Registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "userapi_http_requests_total",
+			Help: "HTTP requests by route and status.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "userapi_http_request_duration_seconds",
+			Help:    "HTTP request latency by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "userapi_db_operation_duration_seconds",
+			Help:    "Latency of database operations.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation"}),
+		dbErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "userapi_db_operation_errors_total",
+			Help: "Database operations that returned an error, including lookups of missing rows.",
+		}, []string{"operation"}),
+		authAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "userapi_auth_attempts_total",
+			Help: "Authentication attempts by method and outcome.",
+		}, []string{"method", "outcome"}),
+		passwordHashing: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "userapi_password_hash_duration_seconds",
+			Help:    "Time spent hashing and verifying passwords.",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"algorithm", "operation"}),
+	}
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration, m.dbDuration, m.dbErrors, m.authAttempts, m.passwordHashing,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "userapi_user_cache_size",
+			Help: "Users in the in-memory user cache.",
+		}, func() float64 { return float64(s.Users.len()) }),
+	)
+	for result, count := range map[string]*atomic.Uint64{"hit": &s.Users.hits, "miss": &s.Users.misses} {
+		m.Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "userapi_user_cache_lookups_total",
+			Help:        "Lookups in the in-memory user cache by result, hit or miss.",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 { return float64(count.Load()) }))
+	}
+	return &m
+}
+
+// middleware counts and times every request by its route pattern.
+func (m *Metrics) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		m.httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// handler serves the registry behind a bearer token, or only to clients on
+// the loopback interface if no token is configured.
+func (m *Metrics) handler(token string) gin.HandlerFunc {
+	metrics := promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+	return func(c *gin.Context) {
+		if token == "" {
+			ip := net.ParseIP(c.ClientIP())
+			if ip == nil || !ip.IsLoopback() {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+		} else if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+token)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+func (m *Metrics) authAttempt(method string, ok bool) {
+	outcome := "failure"
+	if ok {
+		outcome = "success"
+	}
+	m.authAttempts.WithLabelValues(method, outcome).Inc()
+}
+
+// instrumentPasswords makes every hasher of p record its latency.
+func (m *Metrics) instrumentPasswords(p *Passwords) {
+	p.Current = timedHasher{p.Current, m.passwordHashing}
+	for i, hasher := range p.Known {
+		p.Known[i] = timedHasher{hasher, m.passwordHashing}
+	}
+}
+
+type timedHasher struct {
+	PasswordHasher
+	duration *prometheus.HistogramVec
+}
+
+func (h timedHasher) observe(operation string, start time.Time) {
+	h.duration.WithLabelValues(h.Name(), operation).Observe(time.Since(start).Seconds())
+}
+
+func (h timedHasher) Hash(password string) (string, error) {
+	defer h.observe("hash", time.Now())
+	return h.PasswordHasher.Hash(password)
+}
+
+func (h timedHasher) Verify(encoded string, password string) (bool, error) {
+	defer h.observe("verify", time.Now())
+	return h.PasswordHasher.Verify(encoded, password)
+}
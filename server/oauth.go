@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// authorizationCodeTTL bounds the time between consent and the token request,
+// and between showing the consent page and submitting it.
+const authorizationCodeTTL = time.Minute
+
+type OAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// Public clients cannot keep a secret and rely on PKCE alone
+	Public bool `json:"public"`
+}
+
+type OAuthClientResponse struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// authorizationRequest holds the validated parameters of a request to
+// /oauth/authorize.
+type authorizationRequest struct {
+	Client      spec.OAuthClient
+	RedirectURI string
+	// RedirectURISent is set if the request had a redirect_uri instead of
+	// defaulting to the only registered one, so the token request must repeat it
+	RedirectURISent bool
+	Scopes          []string
+	State           string
+	Nonce           string
+	CodeChallenge   string
+}
+
+type authorizationCode struct {
+	authorizationRequest
+	Username string
+	AuthTime time.Time
+}
+
+func (r authorizationRequest) redirect(c *gin.Context, params url.Values) {
+	if r.State != "" {
+		params.Set("state", r.State)
+	}
+	target, _ := url.Parse(r.RedirectURI)
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, target.String())
+}
+
+func (r authorizationRequest) redirectError(c *gin.Context, code string, description string) {
+	r.redirect(c, url.Values{"error": {code}, "error_description": {description}})
+}
+
+func newClientID() string {
+	raw := make([]byte, 12)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+func randomToken(n int) string {
+	raw := make([]byte, n)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func createOAuthClient(c *gin.Context, s *ServerContext) {
+	var body OAuthClientRequest
+	err := c.BindJSON(&body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if body.Name == "" || len(body.RedirectURIs) == 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("client needs a name and redirect uris"))
+		return
+	}
+	for _, uri := range body.RedirectURIs {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || strings.ContainsRune(uri, ' ') {
+			c.AbortWithError(http.StatusBadRequest, errors.New("redirect uris must be absolute without a fragment"))
+			return
+		}
+	}
+	client := spec.OAuthClient{
+		ID:           newClientID(),
+		Name:         body.Name,
+		RedirectURIs: body.RedirectURIs,
+		CreatedAt:    time.Now(),
+	}
+	response := OAuthClientResponse{ClientID: client.ID, Name: client.Name, RedirectURIs: client.RedirectURIs}
+	if !body.Public {
+		response.ClientSecret = randomToken(32)
+		client.SecretHash = hashToken(response.ClientSecret)
+	}
+	err = s.db(c).CreateOAuthClient(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, response)
+}
+
+// parseAuthorizationRequest validates an authorization request. Problems with
+// the client or redirect URI are reported to the user agent directly, since the
+// redirect URI cannot be trusted; everything else is redirected to the client.
+func parseAuthorizationRequest(c *gin.Context, s *ServerContext) (authorizationRequest, bool) {
+	client, err := s.db(c).ReadOAuthClient(c.Request.FormValue("client_id"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, errors.New("unknown client_id"))
+		return authorizationRequest{}, false
+	}
+	request := authorizationRequest{
+		Client:          client,
+		RedirectURI:     c.Request.FormValue("redirect_uri"),
+		RedirectURISent: c.Request.FormValue("redirect_uri") != "",
+		State:           c.Request.FormValue("state"),
+		Nonce:           c.Request.FormValue("nonce"),
+		CodeChallenge:   c.Request.FormValue("code_challenge"),
+		Scopes:          strings.Fields(c.Request.FormValue("scope")),
+	}
+	if request.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		request.RedirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, request.RedirectURI) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("redirect_uri is not registered for the client"))
+		return authorizationRequest{}, false
+	}
+	if c.Request.FormValue("response_type") != "code" {
+		request.redirectError(c, "unsupported_response_type", "only the code response type is supported")
+		return authorizationRequest{}, false
+	}
+	if request.CodeChallenge == "" || c.Request.FormValue("code_challenge_method") != "S256" {
+		request.redirectError(c, "invalid_request", "PKCE with code_challenge_method S256 is required")
+		return authorizationRequest{}, false
+	}
+	for _, scope := range request.Scopes {
+		if !slices.Contains(oauthScopes, scope) {
+			request.redirectError(c, "invalid_scope", "unknown scope "+scope)
+			return authorizationRequest{}, false
+		}
+	}
+	return request, true
+}
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Authorize {{.Client}}</title></head>
+<body>
+<p>{{.Client}} would like to access your account {{.Username}}:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+<form method="post" action="/oauth/authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<button type="submit" name="decision" value="approve">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+// authorize is the authorization endpoint. The user authenticates with Basic
+// Auth, which browsers prompt for, or a session token. Users are asked for
+// consent unless they already allowed the client the requested scopes.
+func authorize(c *gin.Context, s *ServerContext) {
+	request, ok := parseAuthorizationRequest(c, s)
+	if !ok {
+		return
+	}
+	user, ok := authenticate(c, s)
+	if !ok {
+		return
+	}
+	consent, err := s.db(c).ReadOAuthConsent(user.Username, request.Client.ID)
+	if err == nil && isSubset(request.Scopes, consent.Scopes) {
+		issueAuthorizationCode(c, s, request, user.Username)
+		return
+	}
+	// the consent token ties the form submission to this page, so another site
+	// cannot post an approval using the browser's cached credentials
+	consentToken := randomToken(24)
+	s.ConsentTokens.put(consentToken, user.Username, authorizationCodeTTL)
+	params := map[string]string{"consent_token": consentToken}
+	for _, name := range []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+		params[name] = c.Request.FormValue(name)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Status(http.StatusOK)
+	consentPage.Execute(c.Writer, gin.H{
+		"Client":   request.Client.Name,
+		"Username": user.Username,
+		"Scopes":   request.Scopes,
+		"Params":   params,
+	})
+}
+
+// submitConsent handles the consent form.
+func submitConsent(c *gin.Context, s *ServerContext) {
+	request, ok := parseAuthorizationRequest(c, s)
+	if !ok {
+		return
+	}
+	user, ok := authenticate(c, s)
+	if !ok {
+		return
+	}
+	username, found := s.ConsentTokens.take(c.Request.FormValue("consent_token"))
+	if !found || username != user.Username {
+		c.AbortWithError(http.StatusBadRequest, errors.New("consent form expired"))
+		return
+	}
+	if c.Request.FormValue("decision") != "approve" {
+		request.redirectError(c, "access_denied", "the user denied the request")
+		return
+	}
+	err := s.db(c).SaveOAuthConsent(spec.OAuthConsent{
+		Username:  user.Username,
+		ClientID:  request.Client.ID,
+		Scopes:    request.Scopes,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	issueAuthorizationCode(c, s, request, user.Username)
+}
+
+func issueAuthorizationCode(c *gin.Context, s *ServerContext, request authorizationRequest, username string) {
+	code := randomToken(32)
+	s.AuthorizationCodes.put(hashToken(code), authorizationCode{
+		authorizationRequest: request,
+		Username:             username,
+		AuthTime:             time.Now(),
+	}, authorizationCodeTTL)
+	request.redirect(c, url.Values{"code": {code}})
+}
+
+func isSubset(subset []string, set []string) bool {
+	for _, item := range subset {
+		if !slices.Contains(set, item) {
+			return false
+		}
+	}
+	return true
+}
+
+func abortOAuth(c *gin.Context, status int, code string, description string) {
+	c.Header("Cache-Control", "no-store")
+	c.AbortWithStatusJSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// authenticateClient checks client_secret_basic, client_secret_post, or for
+// public clients just the client_id.
+func authenticateClient(c *gin.Context, s *ServerContext) (spec.OAuthClient, bool) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if !basic {
+		clientID = c.Request.PostFormValue("client_id")
+		secret = c.Request.PostFormValue("client_secret")
+	}
+	client, err := s.db(c).ReadOAuthClient(clientID)
+	if err != nil {
+		abortOAuth(c, http.StatusUnauthorized, "invalid_client", "unknown client")
+		return spec.OAuthClient{}, false
+	}
+	if client.SecretHash == "" && secret == "" {
+		return client, true
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		abortOAuth(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return spec.OAuthClient{}, false
+	}
+	return client, true
+}
+
+// token is the token endpoint, exchanging authorization codes for access tokens
+// and, with the openid scope, ID tokens.
+func token(c *gin.Context, s *ServerContext) {
+	client, ok := authenticateClient(c, s)
+	if !ok {
+		return
+	}
+	if c.Request.PostFormValue("grant_type") != "authorization_code" {
+		abortOAuth(c, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	// the code is only consumed once the request proves it belongs to the
+	// client, so a leaked code cannot be burnt by anyone else
+	codeHash := hashToken(c.Request.PostFormValue("code"))
+	code, found := s.AuthorizationCodes.get(codeHash)
+	// RFC 6749 section 4.1.3: redirect_uri must match if it was in the
+	// authorization request
+	redirectURI := c.Request.PostFormValue("redirect_uri")
+	redirectMismatch := (code.RedirectURISent || redirectURI != "") && redirectURI != code.RedirectURI
+	if !found || code.Client.ID != client.ID || redirectMismatch {
+		abortOAuth(c, http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+		return
+	}
+	verifier := sha256.Sum256([]byte(c.Request.PostFormValue("code_verifier")))
+	challenge := base64.RawURLEncoding.EncodeToString(verifier[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(code.CodeChallenge)) != 1 {
+		abortOAuth(c, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+		return
+	}
+	if _, found := s.AuthorizationCodes.take(codeHash); !found {
+		abortOAuth(c, http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+		return
+	}
+	if user, found := s.Users.lookup(code.Username); !found || user.Status != spec.StatusActive {
+		abortOAuth(c, http.StatusBadRequest, "invalid_grant", "user no longer exists or is not active")
+		return
+	}
+	accessToken, err := issueAccessToken(s, code.Username, client.ID, code.Scopes)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	response := gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(s.Config.AccessTokenTTL.Seconds()),
+		"scope":        strings.Join(code.Scopes, " "),
+	}
+	if slices.Contains(code.Scopes, scopeOpenID) {
+		response["id_token"], err = issueIDToken(s, code)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
+
+// introspect implements RFC 7662 token introspection for confidential clients.
+func introspect(c *gin.Context, s *ServerContext) {
+	client, ok := authenticateClient(c, s)
+	if !ok {
+		return
+	}
+	if client.SecretHash == "" {
+		abortOAuth(c, http.StatusUnauthorized, "invalid_client", "public clients cannot introspect tokens")
+		return
+	}
+	claims, err := parseAccessToken(s, c.Request.PostFormValue("token"))
+	// tokens of users who were suspended or deleted since are no longer active
+	if user, found := s.Users.lookup(claims.Subject); err != nil || !found || user.Status != spec.StatusActive {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"active":     true,
+		"scope":      claims.Scope,
+		"client_id":  claims.ClientID,
+		"username":   claims.Subject,
+		"sub":        claims.Subject,
+		"token_type": "Bearer",
+		"iss":        claims.Issuer,
+		"exp":        claims.ExpiresAt.Unix(),
+		"iat":        claims.IssuedAt.Unix(),
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jameshw-dev01/user-api/database"
+	"github.com/jameshw-dev01/user-api/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	// the flow makes more OAuth requests than the default limit allows
+	s.Config.SignupRateLimit.Rule.Limit = 100
+	router := newRouter(s)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	admin := s.Users.get("john_doe")
+	admin.Admin = true
+	s.DB.Update(admin)
+	s.Users.put(admin)
+
+	// register a confidential client
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/oauth/clients", strings.NewReader(`{"name": "Wiki", "redirect_uris": ["https://wiki.example.com/callback"]}`))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var client OAuthClientResponse
+	json.Unmarshal(w.Body.Bytes(), &client)
+
+	verifier := "a-code-verifier-that-is-long-enough-for-pkce-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {"https://wiki.example.com/callback"},
+		"scope":                 {"openid profile email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	// unauthenticated users are asked to log in
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth/authorize?"+query.Encode(), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// the consent page carries a consent token
+	w = httptest.NewRecorder()
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	page := w.Body.String()
+	start := strings.Index(page, `name="consent_token" value="`) + len(`name="consent_token" value="`)
+	query.Set("consent_token", page[start:start+strings.Index(page[start:], `"`)])
+	query.Set("decision", "approve")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth/authorize", strings.NewReader(query.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	location, _ := url.Parse(w.Header().Get("Location"))
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://wiki.example.com/callback"},
+		"code_verifier": {verifier},
+	}
+	// failed exchanges do not use up the code
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader(exchange.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ClientID, "wrong")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	wrongVerifier := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://wiki.example.com/callback"}, "code_verifier": {"wrong"}}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader(wrongVerifier.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ClientID, client.ClientSecret)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader(exchange.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ClientID, client.ClientSecret)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+
+	var idClaims IDTokenClaims
+	_, err := jwt.ParseWithClaims(tokens.IDToken, &idClaims, func(t *jwt.Token) (interface{}, error) {
+		return &s.SigningKey.Key.PublicKey, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "n-0S6", idClaims.Nonce)
+	assert.Equal(t, "test@example.com", idClaims.Email)
+
+	// codes are single use
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader(exchange.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ClientID, client.ClientSecret)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"sub": "john_doe", "name": "John Doe", "email": "test@example.com"}`, w.Body.String())
+
+	// an ID token is not an access token
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.IDToken)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth/introspect", strings.NewReader(url.Values{"token": {tokens.AccessToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ClientID, client.ClientSecret)
+	router.ServeHTTP(w, req)
+	var introspection map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &introspection)
+	assert.Equal(t, true, introspection["active"])
+	assert.Equal(t, "john_doe", introspection["sub"])
+
+	// consent is remembered
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth/authorize?"+query.Encode(), nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	// a redirect_uri left out of the authorization request can be left out of
+	// the token request, but must not differ from the registered one
+	query.Del("redirect_uri")
+	for _, redirectURI := range []string{"https://evil.example.com/callback", ""} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/oauth/authorize?"+query.Encode(), nil)
+		req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusFound, w.Code)
+		location, _ = url.Parse(w.Header().Get("Location"))
+		exchange.Set("code", location.Query().Get("code"))
+		exchange.Set("redirect_uri", redirectURI)
+		if redirectURI == "" {
+			exchange.Del("redirect_uri")
+		}
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader(exchange.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ClientID, client.ClientSecret)
+		router.ServeHTTP(w, req)
+		if redirectURI == "" {
+			assert.Equal(t, http.StatusOK, w.Code)
+		} else {
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		}
+	}
+
+	// tokens stop working once the user is no longer active
+	suspended := s.Users.get("john_doe")
+	suspended.Status = spec.StatusSuspended
+	s.Users.put(suspended)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth/introspect", strings.NewReader(url.Values{"token": {tokens.AccessToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ClientID, client.ClientSecret)
+	router.ServeHTTP(w, req)
+	assert.JSONEq(t, `{"active": false}`, w.Body.String())
+}
+
+func TestOpenIDDiscovery(t *testing.T) {
+	router := setupRouter(true)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var discovery map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &discovery)
+	assert.Equal(t, "http://localhost:8080/oauth/jwks", discovery["jwks_uri"])
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth/jwks", nil)
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), `"kty": "RSA"`)
+}
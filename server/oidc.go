@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+const (
+	scopeOpenID  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+	// accessTokenType is the JWT typ of access tokens (RFC 9068), so an ID token
+	// cannot be used as an access token
+	accessTokenType = "at+jwt"
+)
+
+var oauthScopes = []string{scopeOpenID, scopeProfile, scopeEmail}
+
+// SigningKey signs the access and ID tokens and is published in the JWKS.
+type SigningKey struct {
+	Key *rsa.PrivateKey
+	ID  string
+}
+
+// loadSigningKey reads a PEM encoded RSA private key from path, or generates
+// one if path is empty. A generated key only lives as long as the process, so
+// tokens it signed stop validating on restart.
+func loadSigningKey(path string) (SigningKey, error) {
+	var key *rsa.PrivateKey
+	if path == "" {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return SigningKey{}, err
+		}
+	} else {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return SigningKey{}, errors.New(path + ": no PEM data")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return SigningKey{}, err
+		}
+		var ok bool
+		key, ok = parsed.(*rsa.PrivateKey)
+		if !ok {
+			return SigningKey{}, errors.New(path + ": not an RSA key")
+		}
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	sum := sha256.Sum256(der)
+	return SigningKey{Key: key, ID: base64.RawURLEncoding.EncodeToString(sum[:12])}, nil
+}
+
+type AccessTokenClaims struct {
+	jwt.RegisteredClaims
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+}
+
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	AuthTime int64  `json:"auth_time"`
+	Nonce    string `json:"nonce,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+func newTokenID() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func (s *ServerContext) signToken(claims jwt.Claims, typ string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.SigningKey.ID
+	token.Header["typ"] = typ
+	return token.SignedString(s.SigningKey.Key)
+}
+
+func issueAccessToken(s *ServerContext, username string, clientID string, scopes []string) (string, error) {
+	now := time.Now()
+	claims := AccessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.Config.OAuthIssuer,
+			Subject:   username,
+			Audience:  jwt.ClaimStrings{s.Config.OAuthIssuer},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.Config.AccessTokenTTL)),
+			ID:        newTokenID(),
+		},
+		ClientID: clientID,
+		Scope:    strings.Join(scopes, " "),
+	}
+	return s.signToken(claims, accessTokenType)
+}
+
+func issueIDToken(s *ServerContext, code authorizationCode) (string, error) {
+	user := s.Users.get(code.Username)
+	now := time.Now()
+	claims := IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.Config.OAuthIssuer,
+			Subject:   code.Username,
+			Audience:  jwt.ClaimStrings{code.Client.ID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.Config.AccessTokenTTL)),
+		},
+		AuthTime: code.AuthTime.Unix(),
+		Nonce:    code.Nonce,
+	}
+	if slices.Contains(code.Scopes, scopeProfile) {
+		claims.Name = user.Name
+	}
+	if slices.Contains(code.Scopes, scopeEmail) {
+		claims.Email = user.Email
+	}
+	return s.signToken(claims, "JWT")
+}
+
+// parseAccessToken verifies an access token issued by this server.
+func parseAccessToken(s *ServerContext, token string) (AccessTokenClaims, error) {
+	var claims AccessTokenClaims
+	parsed, err := jwt.ParseWithClaims(
+		token,
+		&claims,
+		func(t *jwt.Token) (interface{}, error) { return &s.SigningKey.Key.PublicKey, nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(s.Config.OAuthIssuer),
+		jwt.WithAudience(s.Config.OAuthIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return AccessTokenClaims{}, err
+	}
+	if parsed.Header["typ"] != accessTokenType {
+		return AccessTokenClaims{}, errors.New("not an access token")
+	}
+	return claims, nil
+}
+
+func openIDConfiguration(c *gin.Context, s *ServerContext) {
+	issuer := s.Config.OAuthIssuer
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"introspection_endpoint":                issuer + "/oauth/introspect",
+		"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+		"jwks_uri":                              issuer + "/oauth/jwks",
+		"scopes_supported":                      oauthScopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"claims_supported":                      []string{"sub", "name", "email"},
+	})
+}
+
+func jwks(c *gin.Context, s *ServerContext) {
+	public := s.SigningKey.Key.PublicKey
+	c.IndentedJSON(http.StatusOK, gin.H{"keys": []gin.H{{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": s.SigningKey.ID,
+		"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+	}}})
+}
+
+// userinfo returns the claims of the user an access token was issued for,
+// limited to the scopes the user consented to.
+func userinfo(c *gin.Context, s *ServerContext) {
+	token, isBearer := bearerToken(c)
+	if !isBearer {
+		c.Header("WWW-Authenticate", `Bearer realm="user-api"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	claims, err := parseAccessToken(s, token)
+	user, found := s.Users.lookup(claims.Subject)
+	if err != nil || !found || user.Status != spec.StatusActive {
+		c.Header("WWW-Authenticate", `Bearer realm="user-api", error="invalid_token"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	scopes := strings.Fields(claims.Scope)
+	if !slices.Contains(scopes, scopeOpenID) {
+		c.Header("WWW-Authenticate", `Bearer realm="user-api", error="insufficient_scope"`)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	info := gin.H{"sub": user.Username}
+	if slices.Contains(scopes, scopeProfile) {
+		info["name"] = user.Name
+	}
+	if slices.Contains(scopes, scopeEmail) {
+		info["email"] = user.Email
+	}
+	c.IndentedJSON(http.StatusOK, info)
+}
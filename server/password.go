@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher is one password hashing algorithm. Hashes are stored as
+// self-describing strings: bcrypt's own "$2a$..." format and the PHC string
+// format for argon2id, so the algorithm and parameters can be read back.
+type PasswordHasher interface {
+	// Name is the algorithm, e.g. "bcrypt"
+	Name() string
+	Hash(password string) (string, error)
+	// Identifies reports whether encoded was produced by this algorithm
+	Identifies(encoded string) bool
+	// Check returns why encoded, which this algorithm identifies, cannot be
+	// stored and verified, or nil if it can
+	Check(encoded string) error
+	Verify(encoded string, password string) (bool, error)
+	// NeedsRehash reports whether encoded was made with other parameters than
+	// the hasher is configured with
+	NeedsRehash(encoded string) bool
+}
+
+// maxBcryptCost is the highest cost of an imported bcrypt hash, unless the
+// hasher is configured with a higher one, so an import cannot make every
+// login take minutes.
+const maxBcryptCost = 16
+
+type bcryptHasher struct {
+	Cost int
+}
+
+func (h bcryptHasher) Name() string {
+	return "bcrypt"
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+func (h bcryptHasher) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2")
+}
+
+func (h bcryptHasher) Check(encoded string) error {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return err
+	}
+	if cost > max(maxBcryptCost, h.Cost) {
+		return fmt.Errorf("bcrypt cost %d is too high", cost)
+	}
+	return nil
+}
+
+func (h bcryptHasher) Verify(encoded string, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// Bounds of the argon2id parameters a hash can be verified with. The upper
+// ones can be raised by configuring the hasher with more, and keep a hash
+// from using up the memory or time of the server.
+const (
+	maxArgon2Memory     = 256 * 1024
+	maxArgon2Iterations = 16
+	minArgon2SaltLength = 8
+	minArgon2KeyLength  = 4
+)
+
+type argon2idHasher struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  int
+	KeyLength   uint32
+}
+
+var phcEncoding = base64.RawStdEncoding
+
+func (h argon2idHasher) Name() string {
+	return "argon2id"
+}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h argon2idHasher) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// decode parses a PHC string into the parameters, salt and key it records,
+// and rejects parameters outside the bounds argon2id can be verified with.
+func (h argon2idHasher) decode(encoded string) (argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return argon2idHasher{}, nil, nil, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2idHasher{}, nil, nil, errors.New("unsupported argon2 version")
+	}
+	var params argon2idHasher
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return argon2idHasher{}, nil, nil, errors.New("malformed argon2id parameters")
+	}
+	salt, err := phcEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2idHasher{}, nil, nil, err
+	}
+	key, err := phcEncoding.DecodeString(parts[5])
+	if err != nil {
+		return argon2idHasher{}, nil, nil, err
+	}
+	params.SaltLength = len(salt)
+	params.KeyLength = uint32(len(key))
+	switch {
+	case params.Memory == 0 || params.Memory > max(maxArgon2Memory, h.Memory):
+		return argon2idHasher{}, nil, nil, errors.New("argon2id memory out of range")
+	case params.Iterations == 0 || params.Iterations > max(maxArgon2Iterations, h.Iterations):
+		return argon2idHasher{}, nil, nil, errors.New("argon2id iterations out of range")
+	case params.Parallelism == 0:
+		return argon2idHasher{}, nil, nil, errors.New("argon2id parallelism out of range")
+	case params.SaltLength < minArgon2SaltLength || params.KeyLength < minArgon2KeyLength:
+		return argon2idHasher{}, nil, nil, errors.New("argon2id salt or key too short")
+	}
+	return params, salt, key, nil
+}
+
+func (h argon2idHasher) Check(encoded string) error {
+	_, _, _, err := h.decode(encoded)
+	return err
+}
+
+func (h argon2idHasher) Verify(encoded string, password string) (bool, error) {
+	params, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	actual := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (h argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := h.decode(encoded)
+	return err != nil || params != h
+}
+
+// Passwords hashes new passwords with the configured hasher and verifies
+// stored hashes made by any supported algorithm.
+type Passwords struct {
+	Current PasswordHasher
+	Known   []PasswordHasher
+	dummy   string
+}
+
+func newPasswords(current PasswordHasher) (*Passwords, error) {
+	p := Passwords{
+		Current: current,
+		Known:   []PasswordHasher{current, bcryptHasher{Cost: bcrypt.DefaultCost}, argon2idHasher{}},
+	}
+	// dummy is verified against when a user does not exist, so an unknown
+	// username costs the same work as a wrong password
+	var err error
+	p.dummy, err = current.Hash("dummy password")
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Passwords) Hash(ctx context.Context, password string) (string, error) {
+	_, span := tracer.Start(ctx, "password.hash", trace.WithAttributes(attribute.String("password.algorithm", p.Current.Name())))
+	defer span.End()
+	return p.Current.Hash(password)
+}
+
+// Verify checks password against encoded. When it matches, rehash reports
+// whether encoded should be replaced by a hash from the current hasher.
+func (p *Passwords) Verify(ctx context.Context, encoded string, password string) (ok bool, rehash bool, err error) {
+	for _, hasher := range p.Known {
+		if !hasher.Identifies(encoded) {
+			continue
+		}
+		_, span := tracer.Start(ctx, "password.verify", trace.WithAttributes(attribute.String("password.algorithm", hasher.Name())))
+		defer span.End()
+		ok, err = hasher.Verify(encoded, password)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, !p.Current.Identifies(encoded) || p.Current.NeedsRehash(encoded), nil
+	}
+	return false, false, errors.New("unknown password hash format")
+}
+
+// Check returns why encoded is not a hash that a supported algorithm can
+// verify, or nil if it is one.
+func (p *Passwords) Check(encoded string) error {
+	for _, hasher := range p.Known {
+		if hasher.Identifies(encoded) {
+			return hasher.Check(encoded)
+		}
+	}
+	return errors.New("unknown password hash format")
+}
+
+// VerifyDummy does the work of Verify without a stored hash and always fails.
+func (p *Passwords) VerifyDummy(ctx context.Context, password string) {
+	p.Verify(ctx, p.dummy, password)
+}
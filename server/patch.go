@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// patchMembers maps the members of the UserResponse document a patch applies
+// to onto the spec.User fields they are stored in.
+var patchMembers = map[string]string{"name": "Name", "email": "Email", "age": "Age"}
+
+// PatchOperation is one operation of a JSON Patch (RFC 6902).
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// errPatchTestFailed is returned when a JSON Patch test operation does not hold.
+var errPatchTestFailed = errors.New("patch test failed")
+
+// patchUser applies a JSON Merge Patch or a JSON Patch to the profile of the
+// user. Only the members the patch touches are written, so they can be set to
+// zero values.
+func patchUser(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	before := s.Users.get(username)
+	if !checkVersion(c, before) {
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	doc := map[string]json.RawMessage{}
+	current, _ := json.Marshal(UserResponse{Name: before.Name, Email: before.Email, Age: before.Age})
+	json.Unmarshal(current, &doc)
+	var touched []string
+	switch c.ContentType() {
+	case mergePatchType:
+		touched, err = applyMergePatch(doc, body)
+	case jsonPatchType:
+		touched, err = applyJSONPatch(doc, body)
+	default:
+		c.Header("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		c.AbortWithError(http.StatusUnsupportedMediaType, errors.New("patch must be "+mergePatchType+" or "+jsonPatchType))
+		return
+	}
+	if errors.Is(err, errPatchTestFailed) {
+		c.AbortWithError(http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	// members removed by the patch are missing from doc and left at zero
+	var patched UserResponse
+	result, _ := json.Marshal(doc)
+	err = json.Unmarshal(result, &patched)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if !isUserValid(patched) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("user data is invalid"))
+		return
+	}
+	user := before
+	user.Name = patched.Name
+	user.Email = patched.Email
+	user.Age = patched.Age
+	var fields []string
+	for _, member := range touched {
+		if !slices.Contains(fields, patchMembers[member]) {
+			fields = append(fields, patchMembers[member])
+		}
+	}
+	if len(fields) == 0 {
+		c.Header("ETag", versionETag(before))
+		c.IndentedJSON(http.StatusOK, patched)
+		return
+	}
+	saveProfile(c, s, before, user, fields)
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396) to doc and returns the
+// members it set or removed.
+func applyMergePatch(doc map[string]json.RawMessage, body []byte) ([]string, error) {
+	var patch map[string]json.RawMessage
+	err := json.Unmarshal(body, &patch)
+	if err != nil {
+		return nil, err
+	}
+	var touched []string
+	for member, value := range patch {
+		if _, ok := patchMembers[member]; !ok {
+			return nil, fmt.Errorf("unknown member %q", member)
+		}
+		if string(value) == "null" {
+			delete(doc, member)
+		} else {
+			doc[member] = value
+		}
+		touched = append(touched, member)
+	}
+	return touched, nil
+}
+
+// applyJSONPatch applies the operations of a JSON Patch (RFC 6902) to doc in
+// order and returns the members they set or removed. The patch is all or
+// nothing: on error doc must be discarded.
+func applyJSONPatch(doc map[string]json.RawMessage, body []byte) ([]string, error) {
+	var operations []PatchOperation
+	err := json.Unmarshal(body, &operations)
+	if err != nil {
+		return nil, err
+	}
+	var touched []string
+	for i, operation := range operations {
+		member, err := patchMember(operation.Path)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+		value, exists := doc[member]
+		switch operation.Op {
+		case "add", "replace":
+			if operation.Value == nil {
+				return nil, fmt.Errorf("operation %d: value is required", i)
+			}
+			if operation.Op == "replace" && !exists {
+				return nil, fmt.Errorf("operation %d: %s does not exist", i, operation.Path)
+			}
+			doc[member] = operation.Value
+		case "remove":
+			if !exists {
+				return nil, fmt.Errorf("operation %d: %s does not exist", i, operation.Path)
+			}
+			delete(doc, member)
+		case "move", "copy":
+			from, err := patchMember(operation.From)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+			fromValue, ok := doc[from]
+			if !ok {
+				return nil, fmt.Errorf("operation %d: %s does not exist", i, operation.From)
+			}
+			if operation.Op == "move" && from != member {
+				delete(doc, from)
+				touched = append(touched, from)
+			}
+			doc[member] = fromValue
+		case "test":
+			if !exists || !jsonEqual(value, operation.Value) {
+				return nil, fmt.Errorf("operation %d: %w", i, errPatchTestFailed)
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i, operation.Op)
+		}
+		touched = append(touched, member)
+	}
+	return touched, nil
+}
+
+// patchMember returns the member of the profile a JSON Pointer refers to.
+func patchMember(pointer string) (string, error) {
+	member, found := strings.CutPrefix(pointer, "/")
+	if _, ok := patchMembers[member]; !found || !ok {
+		return "", fmt.Errorf("unknown path %q", pointer)
+	}
+	return member, nil
+}
+
+func jsonEqual(a json.RawMessage, b json.RawMessage) bool {
+	var decodedA, decodedB interface{}
+	if json.Unmarshal(a, &decodedA) != nil || json.Unmarshal(b, &decodedB) != nil {
+		return false
+	}
+	return reflect.DeepEqual(decodedA, decodedB)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors struct {
+	Errors []FieldError `json:"errors"`
+}
+
+// PasswordPolicy is checked whenever a password is set.
+type PasswordPolicy struct {
+	MinLength int
+	// MaxLength is in bytes; bcrypt refuses passwords over 72 bytes
+	MaxLength int
+	// MinClasses is how many of lowercase, uppercase, digits and symbols must be used
+	MinClasses int
+	// DisallowUsername rejects passwords containing the username
+	DisallowUsername bool
+	// MinScore is the lowest acceptable passwordScore, from 0 to 4
+	MinScore int
+	Breached BreachedPasswords
+}
+
+// commonPasswords score 0 whatever their length.
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "123456": true, "12345678": true,
+	"123456789": true, "1234567890": true, "qwerty": true, "qwertyuiop": true, "abc123": true,
+	"111111": true, "iloveyou": true, "admin": true, "welcome": true, "letmein": true,
+	"monkey": true, "dragon": true, "football": true, "baseball": true, "sunshine": true,
+	"princess": true, "trustno1": true, "passw0rd": true, "master": true, "superman": true,
+}
+
+// passwordScore estimates password strength on zxcvbn's 0 to 4 scale from the
+// size of the character pool and the length left after discounting repeated
+// and sequential characters.
+func passwordScore(password string) int {
+	if commonPasswords[strings.ToLower(password)] {
+		return 0
+	}
+	pool := 0
+	lower, upper, digit, symbol := characterClasses(password)
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	effective := 0
+	var previous rune = -1
+	for _, r := range password {
+		if r != previous && r != previous+1 && r != previous-1 {
+			effective++
+		}
+		previous = r
+	}
+	// log10 of the guesses needed, compared with zxcvbn's score thresholds
+	guesses := float64(effective) * math.Log10(float64(max(pool, 1)))
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func characterClasses(password string) (lower, upper, digit, symbol bool) {
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	return
+}
+
+// Check returns every way password breaks the policy, or nil.
+func (p PasswordPolicy) Check(username string, password string) ([]FieldError, error) {
+	var errs []FieldError
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: "password", Message: fmt.Sprintf(format, args...)})
+	}
+	if len([]rune(password)) < p.MinLength {
+		add("must be at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		add("must be at most %d bytes", p.MaxLength)
+	}
+	classes := 0
+	lower, upper, digit, symbol := characterClasses(password)
+	for _, used := range []bool{lower, upper, digit, symbol} {
+		if used {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		add("must use at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses)
+	}
+	if p.DisallowUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		add("must not contain the username")
+	}
+	if score := passwordScore(password); score < p.MinScore {
+		add("is too easy to guess (strength %d of 4, at least %d required)", score, p.MinScore)
+	}
+	if p.Breached != nil {
+		breached, err := isBreached(p.Breached, password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			add("has appeared in a data breach")
+		}
+	}
+	return errs, nil
+}
+
+// BreachedPasswords looks up breached password hashes by range, like the
+// k-anonymity API of Have I Been Pwned: given the first five hex characters of
+// a SHA-1 hash it returns the remaining 35 of every breached hash with that
+// prefix and how often each was seen. A remote implementation therefore never
+// learns the full hash.
+type BreachedPasswords interface {
+	Range(prefix string) (map[string]int, error)
+}
+
+func isBreached(breached BreachedPasswords, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, err := breached.Range(hash[:5])
+	if err != nil {
+		return false, err
+	}
+	return suffixes[hash[5:]] > 0, nil
+}
+
+// breachedPasswordFile is a BreachedPasswords loaded from a file with one
+// upper or lowercase SHA-1 hex hash per line, optionally followed by ":count".
+type breachedPasswordFile struct {
+	ranges map[string]map[string]int
+}
+
+func loadBreachedPasswordFile(path string) (*breachedPasswordFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b := breachedPasswordFile{ranges: make(map[string]map[string]int)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		hash, countText, hasCount := strings.Cut(line, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != 40 {
+			return nil, fmt.Errorf("%s: malformed line %q", path, line)
+		}
+		count := 1
+		if hasCount {
+			count, err = strconv.Atoi(countText)
+			if err != nil {
+				return nil, fmt.Errorf("%s: malformed count in %q", path, line)
+			}
+		}
+		if b.ranges[hash[:5]] == nil {
+			b.ranges[hash[:5]] = make(map[string]int)
+		}
+		b.ranges[hash[:5]][hash[5:]] = count
+	}
+	return &b, scanner.Err()
+}
+
+// Range implements BreachedPasswords.
+func (b *breachedPasswordFile) Range(prefix string) (map[string]int, error) {
+	return b.ranges[strings.ToUpper(prefix)], nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitRule is a token bucket holding at most Limit tokens that refills
+// completely over Period. A zero Limit disables limiting.
+type RateLimitRule struct {
+	Limit  int
+	Period time.Duration
+}
+
+// parseRateLimitRule parses rules of the form "10/1m". "off" disables the limit.
+func parseRateLimitRule(value string) (RateLimitRule, error) {
+	if value == "off" {
+		return RateLimitRule{}, nil
+	}
+	limit, period, found := strings.Cut(value, "/")
+	if !found {
+		return RateLimitRule{}, errors.New("rate limit must look like 10/1m")
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 0 {
+		return RateLimitRule{}, errors.New("rate limit count must be a non-negative integer")
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RateLimitRule{}, errors.New("rate limit period must be a positive duration")
+	}
+	return RateLimitRule{Limit: n, Period: d}, nil
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is the wait until the next token is available
+	RetryAfter time.Duration
+	// Reset is the wait until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimitStore takes tokens from buckets identified by key. The in-memory
+// store only limits a single instance; several instances behind a load
+// balancer need an implementation backed by a shared store.
+type RateLimitStore interface {
+	Take(key string, rule RateLimitRule, now time.Time) (RateLimitResult, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	period  time.Duration
+}
+
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*bucket)}
+}
+
+// Take implements RateLimitStore.
+func (m *memoryRateLimitStore) Take(key string, rule RateLimitRule, now time.Time) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now)
+
+	limit := float64(rule.Limit)
+	rate := limit / rule.Period.Seconds()
+	b, found := m.buckets[key]
+	if !found {
+		b = &bucket{tokens: limit, updated: now, period: rule.Period}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(limit, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	result := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((limit - b.tokens) / rate)
+	return result, nil
+}
+
+// sweep drops buckets that have refilled completely, since a new bucket would
+// be identical. It runs at most once a minute.
+func (m *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) >= b.period {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// RateLimitKeyFunc picks the client identity a bucket belongs to.
+type RateLimitKeyFunc func(c *gin.Context) string
+
+func keyByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// keyByUsername uses the Basic Auth username together with the client IP. The
+// username is not verified yet, so keying by it alone would let another
+// client use up the bucket of a user. Requests without credentials are
+// limited by IP.
+func keyByUsername(c *gin.Context) string {
+	if username, _, ok := c.Request.BasicAuth(); ok {
+		return "user:" + c.ClientIP() + "|" + username
+	}
+	return keyByIP(c)
+}
+
+// keyByAPIKey uses the API key, falling back to the client IP so requests
+// without a key are still limited.
+func keyByAPIKey(c *gin.Context) string {
+	if key, isAPIKey := apiKeyHeader(c); isAPIKey {
+		return "apikey:" + key
+	}
+	return keyByIP(c)
+}
+
+func rateLimitKeyFunc(key string) RateLimitKeyFunc {
+	switch key {
+	case "username":
+		return keyByUsername
+	case "apikey":
+		return keyByAPIKey
+	default:
+		return keyByIP
+	}
+}
+
+// rateLimit limits the route named route, one bucket per client key, and sets
+// the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+func rateLimit(s *ServerContext, route string, limit RouteRateLimit) gin.HandlerFunc {
+	rule := limit.Rule
+	keyFunc := rateLimitKeyFunc(limit.Key)
+	return func(c *gin.Context) {
+		if rule.Limit == 0 {
+			c.Next()
+			return
+		}
+		result, err := s.RateLimiter.Take(route+"|"+keyFunc(c), rule, time.Now())
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Header("RateLimit-Limit", strconv.Itoa(rule.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			c.AbortWithError(http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+			return
+		}
+		c.Next()
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
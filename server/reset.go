@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+type PasswordResetToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type PasswordReset struct {
+	Username string `json:"username"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// issuePasswordReset creates a token that sets the password of the user once,
+// without the old one. Only admins issue them, to hand to the user through
+// another channel.
+func issuePasswordReset(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	if _, found := s.Users.lookup(username); !found {
+		c.AbortWithError(http.StatusNotFound, errors.New("username not found"))
+		return
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	reset := spec.PasswordReset{
+		TokenHash: hashToken(token),
+		Username:  username,
+		ExpiresAt: time.Now().Add(s.Config.PasswordResetTTL),
+	}
+	err := s.db(c).CreatePasswordReset(reset)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	recordAudit(c, s, auditPasswordIssue, username, nil)
+	c.IndentedJSON(http.StatusCreated, PasswordResetToken{Token: token, ExpiresAt: reset.ExpiresAt})
+}
+
+// resetPassword sets a new password with a token from issuePasswordReset and
+// revokes every session of the user.
+func resetPassword(c *gin.Context, s *ServerContext) {
+	var body PasswordReset
+	err := c.BindJSON(&body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	// the policy is checked before the token is used up, so a rejected
+	// password can be retried
+	if !checkPasswordPolicy(c, s, body.Username, body.Password) {
+		return
+	}
+	reset, err := s.db(c).ConsumePasswordReset(hashToken(body.Token))
+	user, found := s.Users.lookup(reset.Username)
+	if err != nil || !found || reset.Username != body.Username || time.Now().After(reset.ExpiresAt) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("invalid or expired reset token"))
+		return
+	}
+	user.Hash, err = s.Passwords.Hash(c, body.Password)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	err = s.db(c).Update(user)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	user.Version++
+	s.Users.put(user)
+	err = s.db(c).DeleteSessions(user.Username, "")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	recordAudit(c, s, auditPasswordReset, user.Username, []spec.FieldChange{{Field: "password"}})
+	c.Status(http.StatusNoContent)
+}
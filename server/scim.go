@@ -0,0 +1,734 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+const (
+	scimUserSchema      = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimExtensionSchema = "urn:user-api:params:scim:schemas:extension:2.0:User"
+	scimListSchema      = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema     = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema     = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimContentType     = "application/scim+json"
+	scimMaxCount        = 200
+)
+
+type SCIMName struct {
+	Formatted string `json:"formatted,omitempty"`
+}
+
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type SCIMExtension struct {
+	Age uint `json:"age"`
+}
+
+type SCIMMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+	Version      string `json:"version"`
+}
+
+// SCIMUser is the RFC 7643 representation of a spec.User. The username is
+// both the id and the userName.
+type SCIMUser struct {
+	Schemas     []string       `json:"schemas"`
+	ID          string         `json:"id,omitempty"`
+	UserName    string         `json:"userName"`
+	Name        *SCIMName      `json:"name,omitempty"`
+	DisplayName string         `json:"displayName,omitempty"`
+	Emails      []SCIMEmail    `json:"emails,omitempty"`
+	Active      *bool          `json:"active,omitempty"`
+	Password    string         `json:"password,omitempty"`
+	Extension   *SCIMExtension `json:"urn:user-api:params:scim:schemas:extension:2.0:User,omitempty"`
+	Meta        *SCIMMeta      `json:"meta,omitempty"`
+}
+
+type SCIMListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []SCIMUser `json:"Resources"`
+}
+
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e scimError) Error() string {
+	return e.detail
+}
+
+func abortSCIM(c *gin.Context, status int, scimType string, detail string) {
+	body := gin.H{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(status), "detail": detail}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	c.Error(errors.New(detail))
+	c.Abort()
+	writeSCIM(c, status, body)
+}
+
+func abortSCIMError(c *gin.Context, err error) {
+	var e scimError
+	if errors.As(err, &e) {
+		abortSCIM(c, e.status, e.scimType, e.detail)
+		return
+	}
+	if errors.Is(err, spec.ErrVersionConflict) {
+		abortSCIM(c, http.StatusPreconditionFailed, "", "resource has changed")
+		return
+	}
+	abortSCIM(c, http.StatusInternalServerError, "", err.Error())
+}
+
+func writeSCIM(c *gin.Context, status int, body interface{}) {
+	data, err := json.MarshalIndent(body, "", "    ")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Data(status, scimContentType, data)
+}
+
+func toSCIMUser(s *ServerContext, user spec.User) SCIMUser {
+	active := user.Status == spec.StatusActive
+	scimUser := SCIMUser{
+		Schemas:     []string{scimUserSchema, scimExtensionSchema},
+		ID:          user.Username,
+		UserName:    user.Username,
+		DisplayName: user.Name,
+		Active:      &active,
+		Extension:   &SCIMExtension{Age: user.Age},
+		Meta: &SCIMMeta{
+			ResourceType: "User",
+			Location:     s.Config.OAuthIssuer + "/scim/v2/Users/" + user.Username,
+			Version:      versionETag(user),
+		},
+	}
+	if user.Name != "" {
+		scimUser.Name = &SCIMName{Formatted: user.Name}
+	}
+	if user.Email != "" {
+		scimUser.Emails = []SCIMEmail{{Value: user.Email, Type: "work", Primary: true}}
+	}
+	return scimUser
+}
+
+// applySCIMUser copies the mutable attributes of scimUser onto user.
+func applySCIMUser(user *spec.User, scimUser SCIMUser) error {
+	user.Name = scimUser.DisplayName
+	if user.Name == "" && scimUser.Name != nil {
+		user.Name = scimUser.Name.Formatted
+	}
+	if user.Name == "" {
+		user.Name = scimUser.UserName
+	}
+	user.Email = primaryEmail(scimUser.Emails)
+	if scimUser.Extension != nil {
+		user.Age = scimUser.Extension.Age
+	}
+	if scimUser.Active != nil {
+		status := spec.StatusSuspended
+		if *scimUser.Active {
+			status = spec.StatusActive
+		}
+		if status != user.Status {
+			if !canTransition(user.Status, status) {
+				return scimError{http.StatusBadRequest, "mutability", "a " + user.Status + " user cannot be made " + status}
+			}
+			*user = withStatus(*user, status, "set through SCIM")
+		}
+	}
+	if !isUserValid(UserResponse{Name: user.Name, Email: user.Email}) {
+		return scimError{http.StatusBadRequest, "invalidValue", "a name and a valid email are required"}
+	}
+	return nil
+}
+
+func primaryEmail(emails []SCIMEmail) string {
+	for _, email := range emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(emails) > 0 {
+		return emails[0].Value
+	}
+	return ""
+}
+
+// runSCIMAuth accepts an API key with the scim scope, sent as a bearer token or
+// in X-API-Key, a client certificate with that scope, or an admin logged in
+// any other way.
+func runSCIMAuth(c *gin.Context, s *ServerContext) {
+	var owner spec.User
+	var ok bool
+	if key, isAPIKey := apiKeyHeader(c); isAPIKey {
+		owner, _, ok = authenticateAPIKey(c, s, key, scopeSCIM)
+	} else if name, identity, isService := clientIdentity(c, s); isService {
+		owner, ok = authenticateClientCert(c, s, name, identity, scopeSCIM)
+	} else {
+		runAdminAuth(c, s)
+		return
+	}
+	if !ok {
+		return
+	}
+	c.Set(actorKey, owner.Username)
+	if !owner.Admin {
+		c.AbortWithError(http.StatusForbidden, errors.New("admin only"))
+		return
+	}
+	c.Next()
+}
+
+// checkIfMatch enforces an If-Match precondition against the user's ETag.
+func checkIfMatch(c *gin.Context, user spec.User) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" || strongETagMatch(ifMatch, versionETag(user)) {
+		return true
+	}
+	abortSCIM(c, http.StatusPreconditionFailed, "", "resource has changed")
+	return false
+}
+
+func scimUser(c *gin.Context, s *ServerContext) (spec.User, bool) {
+	user, found := s.Users.lookup(c.Param("id"))
+	if !found {
+		abortSCIM(c, http.StatusNotFound, "", "user not found")
+		return spec.User{}, false
+	}
+	return user, true
+}
+
+func decodeSCIM(c *gin.Context, body interface{}) bool {
+	err := json.NewDecoder(c.Request.Body).Decode(body)
+	if err != nil {
+		abortSCIM(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return false
+	}
+	return true
+}
+
+func scimCreateUser(c *gin.Context, s *ServerContext) {
+	var body SCIMUser
+	if !decodeSCIM(c, &body) {
+		return
+	}
+	if body.UserName == "" {
+		abortSCIM(c, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+	if usernameTaken(c, s, body.UserName) {
+		abortSCIM(c, http.StatusConflict, "uniqueness", "userName already in use")
+		return
+	}
+	user := spec.User{Username: body.UserName, Status: spec.StatusActive, StatusChangedAt: time.Now()}
+	err := applySCIMUser(&user, body)
+	if err != nil {
+		abortSCIMError(c, err)
+		return
+	}
+	// users provisioned without a password can only log in with a passkey or
+	// after an admin sets one
+	if body.Password != "" {
+		errs, err := s.Config.PasswordPolicy.Check(user.Username, body.Password)
+		if err != nil {
+			abortSCIMError(c, err)
+			return
+		}
+		if len(errs) > 0 {
+			abortSCIM(c, http.StatusBadRequest, "invalidValue", "password "+errs[0].Message)
+			return
+		}
+		user.Hash, err = s.Passwords.Hash(c, body.Password)
+		if err != nil {
+			abortSCIMError(c, err)
+			return
+		}
+	}
+	err = s.db(c).Create(user)
+	if err != nil {
+		abortSCIMError(c, err)
+		return
+	}
+	s.Users.put(user)
+	recordAudit(c, s, auditUserCreate, user.Username, userChanges(spec.User{}, user))
+	c.Header("Location", s.Config.OAuthIssuer+"/scim/v2/Users/"+user.Username)
+	c.Header("ETag", versionETag(user))
+	writeSCIM(c, http.StatusCreated, toSCIMUser(s, user))
+}
+
+func scimGetUser(c *gin.Context, s *ServerContext) {
+	user, ok := scimUser(c, s)
+	if !ok {
+		return
+	}
+	etag := versionETag(user)
+	c.Header("ETag", etag)
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" && weakETagMatch(ifNoneMatch, etag) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
+	writeSCIM(c, http.StatusOK, toSCIMUser(s, user))
+}
+
+func scimReplaceUser(c *gin.Context, s *ServerContext) {
+	user, ok := scimUser(c, s)
+	if !ok || !checkIfMatch(c, user) {
+		return
+	}
+	var body SCIMUser
+	if !decodeSCIM(c, &body) {
+		return
+	}
+	if body.UserName != "" && body.UserName != user.Username {
+		abortSCIM(c, http.StatusBadRequest, "mutability", "userName cannot be changed")
+		return
+	}
+	err := applySCIMUser(&user, body)
+	if err != nil {
+		abortSCIMError(c, err)
+		return
+	}
+	saveSCIMUser(c, s, user)
+}
+
+// saveSCIMUser writes the attributes SCIM manages, including cleared ones,
+// and the status if active changed, in one versioned update.
+func saveSCIMUser(c *gin.Context, s *ServerContext, user spec.User) {
+	before := s.Users.get(user.Username)
+	fields := profileFields
+	if user.Status != before.Status {
+		fields = slices.Concat(profileFields, statusFields)
+	}
+	err := s.db(c).UpdateFields(user, fields)
+	if err != nil {
+		abortSCIMError(c, err)
+		return
+	}
+	user.Version++
+	s.Users.put(user)
+	recordAudit(c, s, auditUserUpdate, user.Username, userChanges(before, user))
+	c.Header("ETag", versionETag(user))
+	writeSCIM(c, http.StatusOK, toSCIMUser(s, user))
+}
+
+func scimPatchUser(c *gin.Context, s *ServerContext) {
+	user, ok := scimUser(c, s)
+	if !ok || !checkIfMatch(c, user) {
+		return
+	}
+	var body SCIMPatchRequest
+	if !decodeSCIM(c, &body) {
+		return
+	}
+	if !slices.Contains(body.Schemas, scimPatchSchema) {
+		abortSCIM(c, http.StatusBadRequest, "invalidValue", "request is not a PatchOp")
+		return
+	}
+	scimUser := toSCIMUser(s, user)
+	for _, operation := range body.Operations {
+		err := applySCIMPatch(&scimUser, operation)
+		if err != nil {
+			abortSCIMError(c, err)
+			return
+		}
+	}
+	err := applySCIMUser(&user, scimUser)
+	if err != nil {
+		abortSCIMError(c, err)
+		return
+	}
+	saveSCIMUser(c, s, user)
+}
+
+// applySCIMPatch applies one add, replace or remove operation. Operations
+// without a path carry an object of attributes to set.
+func applySCIMPatch(scimUser *SCIMUser, operation SCIMPatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return scimError{http.StatusBadRequest, "invalidSyntax", "unknown op " + operation.Op}
+	}
+	if operation.Path == "" {
+		if op == "remove" {
+			return scimError{http.StatusBadRequest, "noTarget", "remove needs a path"}
+		}
+		var values map[string]json.RawMessage
+		err := json.Unmarshal(operation.Value, &values)
+		if err != nil {
+			return scimError{http.StatusBadRequest, "invalidValue", "value must be an object"}
+		}
+		for path, value := range values {
+			err = applySCIMPatch(scimUser, SCIMPatchOperation{Op: op, Path: path, Value: value})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	path := strings.ToLower(strings.TrimPrefix(operation.Path, scimUserSchema+":"))
+	var target interface{}
+	switch {
+	case path == "username" || path == "id":
+		return scimError{http.StatusBadRequest, "mutability", operation.Path + " cannot be changed"}
+	case path == "displayname":
+		target = &scimUser.DisplayName
+		if op == "remove" {
+			// name.formatted holds the same name
+			scimUser.Name = nil
+		}
+	case path == "name.formatted":
+		scimUser.Name = &SCIMName{}
+		target = &scimUser.Name.Formatted
+	case path == "name":
+		scimUser.Name = &SCIMName{}
+		target = scimUser.Name
+	case path == "active":
+		target = &scimUser.Active
+	case path == "emails":
+		target = &scimUser.Emails
+	case strings.HasPrefix(path, "emails["):
+		return applySCIMEmailPatch(scimUser, op, strings.TrimPrefix(operation.Path, scimUserSchema+":"), operation.Value)
+	case path == strings.ToLower(scimExtensionSchema):
+		scimUser.Extension = &SCIMExtension{}
+		target = scimUser.Extension
+	case path == strings.ToLower(scimExtensionSchema)+":age":
+		scimUser.Extension = &SCIMExtension{}
+		target = &scimUser.Extension.Age
+	default:
+		return scimError{http.StatusBadRequest, "invalidPath", "unsupported path " + operation.Path}
+	}
+	if op == "remove" {
+		// unmarshalling null leaves strings, numbers and booleans as they are
+		reflect.ValueOf(target).Elem().SetZero()
+		return nil
+	}
+	if json.Unmarshal(operation.Value, target) != nil {
+		return scimError{http.StatusBadRequest, "invalidValue", "invalid value for " + operation.Path}
+	}
+	return nil
+}
+
+// applySCIMEmailPatch applies an operation on a filtered path,
+// emails[filter] or emails[filter].value, to the emails the filter matches.
+// Adding to a path that matches nothing adds an email, typed if the filter is
+// a type eq comparison.
+func applySCIMEmailPatch(scimUser *SCIMUser, op string, path string, value json.RawMessage) error {
+	end := strings.LastIndexByte(path, ']')
+	if end == -1 {
+		return scimError{http.StatusBadRequest, "invalidPath", "unterminated filter in " + path}
+	}
+	subAttribute := strings.ToLower(path[end+1:])
+	if subAttribute != "" && subAttribute != ".value" {
+		return scimError{http.StatusBadRequest, "invalidPath", "unsupported path " + path}
+	}
+	filter, err := parseSCIMFilter(path[len("emails["):end])
+	if err != nil {
+		return scimError{http.StatusBadRequest, "invalidFilter", err.Error()}
+	}
+	var replacement SCIMEmail
+	if op != "remove" {
+		if subAttribute == "" {
+			err = json.Unmarshal(value, &replacement)
+		} else {
+			err = json.Unmarshal(value, &replacement.Value)
+		}
+		if err != nil {
+			return scimError{http.StatusBadRequest, "invalidValue", "invalid value for " + path}
+		}
+	}
+
+	var emails []SCIMEmail
+	matched := false
+	for _, email := range scimUser.Emails {
+		if !filter.matches(emailAttribute(email)) {
+			emails = append(emails, email)
+			continue
+		}
+		matched = true
+		switch {
+		case op == "remove":
+			continue
+		case subAttribute == "":
+			email = replacement
+		default:
+			email.Value = replacement.Value
+		}
+		emails = append(emails, email)
+	}
+	if !matched {
+		if op != "add" {
+			return scimError{http.StatusBadRequest, "noTarget", "no email matches " + path}
+		}
+		if subAttribute != "" && len(filter) == 1 && len(filter[0]) == 1 && filter[0][0].attribute == "type" && filter[0][0].operator == "eq" {
+			replacement.Type = filter[0][0].value
+		}
+		emails = append(emails, replacement)
+	}
+	scimUser.Emails = emails
+	return nil
+}
+
+func scimDeleteUser(c *gin.Context, s *ServerContext) {
+	user, ok := scimUser(c, s)
+	if !ok || !checkIfMatch(c, user) {
+		return
+	}
+	err := deleteAccount(c, s, user, "")
+	if err != nil {
+		abortSCIMError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// scimFilter is a parsed filter of comparisons joined by "and" and "or", where
+// "and" binds tighter. Grouping with parentheses is not supported.
+type scimFilter [][]scimComparison
+
+type scimComparison struct {
+	attribute string
+	operator  string
+	value     string
+}
+
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	tokens, err := tokenizeSCIMFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var parsed scimFilter
+	var and []scimComparison
+	for i := 0; i < len(tokens); {
+		if i+1 >= len(tokens) {
+			return nil, errors.New("incomplete filter")
+		}
+		comparison := scimComparison{attribute: strings.ToLower(tokens[i]), operator: strings.ToLower(tokens[i+1])}
+		i += 2
+		if comparison.operator != "pr" {
+			if i >= len(tokens) {
+				return nil, errors.New("missing value for " + comparison.attribute)
+			}
+			comparison.value = tokens[i]
+			i++
+		}
+		and = append(and, comparison)
+		if i < len(tokens) {
+			switch strings.ToLower(tokens[i]) {
+			case "and":
+			case "or":
+				parsed = append(parsed, and)
+				and = nil
+			default:
+				return nil, errors.New("expected and or or, got " + tokens[i])
+			}
+			i++
+			if i == len(tokens) {
+				return nil, errors.New("filter ends with an operator")
+			}
+		}
+	}
+	return append(parsed, and), nil
+}
+
+// tokenizeSCIMFilter splits a filter on spaces, keeping quoted strings whole
+// and unquoting them.
+func tokenizeSCIMFilter(filter string) ([]string, error) {
+	var tokens []string
+	for filter = strings.TrimSpace(filter); filter != ""; filter = strings.TrimSpace(filter) {
+		if filter[0] == '"' {
+			end := 1
+			for end < len(filter) && (filter[end] != '"' || filter[end-1] == '\\') {
+				end++
+			}
+			if end == len(filter) {
+				return nil, errors.New("unterminated string in filter")
+			}
+			value, err := strconv.Unquote(filter[:end+1])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, value)
+			filter = filter[end+1:]
+			continue
+		}
+		end := strings.IndexByte(filter, ' ')
+		if end == -1 {
+			end = len(filter)
+		}
+		tokens = append(tokens, filter[:end])
+		filter = filter[end:]
+	}
+	return tokens, nil
+}
+
+// matches reports whether the filter matches a resource, given a function
+// returning the values of an attribute of that resource.
+func (f scimFilter) matches(attribute func(name string) []string) bool {
+	for _, and := range f {
+		all := true
+		for _, comparison := range and {
+			all = all && comparison.matches(attribute)
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// userAttribute returns the filter attributes of user.
+func userAttribute(user SCIMUser) func(name string) []string {
+	return func(name string) []string {
+		var values []string
+		switch strings.TrimPrefix(name, strings.ToLower(scimUserSchema)+":") {
+		case "id", "username":
+			values = []string{user.UserName}
+		case "displayname":
+			values = []string{user.DisplayName}
+		case "name.formatted":
+			if user.Name != nil {
+				values = []string{user.Name.Formatted}
+			}
+		case "emails", "emails.value":
+			for _, email := range user.Emails {
+				values = append(values, email.Value)
+			}
+		case "active":
+			values = []string{strconv.FormatBool(user.Active != nil && *user.Active)}
+		}
+		return values
+	}
+}
+
+// emailAttribute returns the filter attributes of an email, for filtered
+// paths such as emails[type eq "work"].
+func emailAttribute(email SCIMEmail) func(name string) []string {
+	return func(name string) []string {
+		switch name {
+		case "value":
+			return []string{email.Value}
+		case "type":
+			return []string{email.Type}
+		case "primary":
+			return []string{strconv.FormatBool(email.Primary)}
+		}
+		return nil
+	}
+}
+
+func (comparison scimComparison) matches(attribute func(name string) []string) bool {
+	for _, value := range attribute(comparison.attribute) {
+		// string attributes of users are compared case-insensitively
+		actual, expected := strings.ToLower(value), strings.ToLower(comparison.value)
+		var match bool
+		switch comparison.operator {
+		case "eq":
+			match = actual == expected
+		case "ne":
+			match = actual != expected
+		case "co":
+			match = strings.Contains(actual, expected)
+		case "sw":
+			match = strings.HasPrefix(actual, expected)
+		case "ew":
+			match = strings.HasSuffix(actual, expected)
+		case "pr":
+			match = actual != ""
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func scimListUsers(c *gin.Context, s *ServerContext) {
+	var filter scimFilter
+	if query := c.Query("filter"); query != "" {
+		var err error
+		filter, err = parseSCIMFilter(query)
+		if err != nil {
+			abortSCIM(c, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+	}
+	startIndex, err := strconv.Atoi(c.DefaultQuery("startIndex", "1"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(scimMaxCount)))
+	if err != nil || count < 0 {
+		count = 0
+	}
+	count = min(count, scimMaxCount)
+
+	users := s.Users.all()
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	matched := []SCIMUser{}
+	for _, user := range users {
+		scimUser := toSCIMUser(s, user)
+		if filter == nil || filter.matches(userAttribute(scimUser)) {
+			matched = append(matched, scimUser)
+		}
+	}
+	page := matched[min(startIndex-1, len(matched)):]
+	page = page[:min(count, len(page))]
+	writeSCIM(c, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(matched),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+func scimServiceProviderConfig(c *gin.Context, s *ServerContext) {
+	writeSCIM(c, http.StatusOK, gin.H{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": scimMaxCount},
+		"changePassword": gin.H{"supported": false},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": true},
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "API key",
+			"description": "An API key with the scim scope sent as a bearer token",
+		}},
+	})
+}
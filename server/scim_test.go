@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jameshw-dev01/user-api/database"
+	"github.com/jameshw-dev01/user-api/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSCIMProvisioning(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	admin := s.Users.get("john_doe")
+	admin.Admin = true
+	s.DB.Update(admin)
+	s.Users.put(admin)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/apikeys", strings.NewReader(`{"name": "idp", "scopes": ["scim"]}`))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var key APIKeyResponse
+	json.Unmarshal(w.Body.Bytes(), &key)
+
+	scim := func(method string, path string, body string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/scim/v2"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key.Key)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = scim("POST", "/Users", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "jane_doe",
+		"name": {"formatted": "Jane Doe"},
+		"emails": [{"value": "jane@example.com", "primary": true}]
+	}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, scimContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "jane@example.com", s.Users.get("jane_doe").Email)
+	etag := w.Header().Get("ETag")
+
+	w = scim("POST", "/Users", `{"userName": "jane_doe", "displayName": "Jane", "emails": [{"value": "jane@example.com"}]}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"uniqueness"`)
+
+	w = scim("GET", "/Users/jane_doe", "", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = scim("GET", "/Users?filter="+strings.ReplaceAll(`userName eq "JANE_DOE"`, " ", "%20"), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list SCIMListResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Equal(t, 1, list.TotalResults)
+	assert.Equal(t, "jane_doe", list.Resources[0].ID)
+
+	w = scim("GET", "/Users?startIndex=2&count=1", "")
+	json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Equal(t, 2, list.TotalResults)
+	assert.Equal(t, "john_doe", list.Resources[0].ID)
+
+	w = scim("PATCH", "/Users/jane_doe", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "replace", "path": "displayName", "value": "Jane Smith"},
+			{"op": "replace", "value": {"urn:user-api:params:scim:schemas:extension:2.0:User:age": 31}}
+		]
+	}`, "If-Match", etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Jane Smith", s.Users.get("jane_doe").Name)
+	assert.Equal(t, uint(31), s.Users.get("jane_doe").Age)
+
+	// removing an attribute writes its zero value
+	w = scim("PATCH", "/Users/jane_doe", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "remove", "path": "urn:user-api:params:scim:schemas:extension:2.0:User:age"},
+			{"op": "remove", "path": "displayName"}
+		]
+	}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	stored, _ := s.DB.Read("jane_doe")
+	assert.Equal(t, uint(0), stored.Age)
+	// the name falls back to the username
+	assert.Equal(t, "jane_doe", stored.Name)
+	w = scim("GET", "/Users/jane_doe", "")
+	var read SCIMUser
+	json.Unmarshal(w.Body.Bytes(), &read)
+	assert.Equal(t, "jane_doe", read.DisplayName)
+
+	w = scim("PATCH", "/Users/jane_doe", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "replace", "path": "active", "value": false}]
+	}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, spec.StatusSuspended, s.Users.get("jane_doe").Status)
+	stored, _ = s.DB.Read("jane_doe")
+	assert.Equal(t, spec.StatusSuspended, stored.Status)
+	assert.Contains(t, w.Body.String(), `"active": false`)
+
+	// the first ETag is stale now
+	w = scim("PUT", "/Users/jane_doe", `{"userName": "jane_doe", "displayName": "Jane", "emails": [{"value": "jane@example.com"}]}`, "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	w = scim("DELETE", "/Users/jane_doe", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = scim("GET", "/Users/jane_doe", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// regular users cannot use SCIM
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("jim_doe", "first-Secret-1")
+	router.ServeHTTP(w, req)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/scim/v2/Users", nil)
+	req.SetBasicAuth("jim_doe", "first-Secret-1")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestParseSCIMFilter(t *testing.T) {
+	filter, err := parseSCIMFilter(`userName sw "j" and emails co "example" or displayName eq "Jane \"JJ\" Doe"`)
+	assert.Nil(t, err)
+	assert.Equal(t, scimFilter{
+		{{"username", "sw", "j"}, {"emails", "co", "example"}},
+		{{"displayname", "eq", `Jane "JJ" Doe`}},
+	}, filter)
+
+	for _, invalid := range []string{`userName eq`, `userName eq "a" and`, `userName eq "a" xor id pr`, `userName eq "a`} {
+		_, err = parseSCIMFilter(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestApplySCIMPatch(t *testing.T) {
+	scimUser := SCIMUser{Emails: []SCIMEmail{
+		{Value: "jane@example.com", Type: "work", Primary: true},
+		{Value: "jane@home.example.com", Type: "home"},
+	}}
+	patch := func(op, path, value string) error {
+		return applySCIMPatch(&scimUser, SCIMPatchOperation{Op: op, Path: path, Value: json.RawMessage(value)})
+	}
+
+	assert.Nil(t, patch("replace", `emails[type eq "home"].value`, `"jane@elsewhere.example.com"`))
+	assert.Equal(t, "jane@example.com", scimUser.Emails[0].Value)
+	assert.Equal(t, "jane@elsewhere.example.com", scimUser.Emails[1].Value)
+
+	assert.Nil(t, patch("remove", `emails[type eq "home"]`, ""))
+	assert.Equal(t, []SCIMEmail{{Value: "jane@example.com", Type: "work", Primary: true}}, scimUser.Emails)
+
+	var err scimError
+	assert.ErrorAs(t, patch("replace", `emails[type eq "home"].value`, `"jane@home.example.com"`), &err)
+	assert.Equal(t, "noTarget", err.scimType)
+	assert.Nil(t, patch("add", `emails[type eq "home"].value`, `"jane@home.example.com"`))
+	assert.Equal(t, SCIMEmail{Value: "jane@home.example.com", Type: "home"}, scimUser.Emails[1])
+	assert.ErrorAs(t, patch("replace", `emails[type eq "home"].display`, `"Home"`), &err)
+	assert.Equal(t, "invalidPath", err.scimType)
+
+	assert.Nil(t, patch("replace", "urn:user-api:params:scim:schemas:extension:2.0:User:age", "31"))
+	assert.Equal(t, uint(31), scimUser.Extension.Age)
+	assert.Nil(t, patch("replace", "urn:user-api:params:scim:schemas:extension:2.0:User", `{"age": 32}`))
+	assert.Equal(t, uint(32), scimUser.Extension.Age)
+	active := true
+	scimUser.DisplayName = "Jane Doe"
+	scimUser.Active = &active
+	for _, path := range []string{"displayName", "active", "urn:user-api:params:scim:schemas:extension:2.0:User:age"} {
+		assert.Nil(t, patch("remove", path, ""), path)
+	}
+	assert.Equal(t, "", scimUser.DisplayName)
+	assert.Nil(t, scimUser.Active)
+	assert.Equal(t, uint(0), scimUser.Extension.Age)
+
+	for _, path := range []string{"image", "storage", "emails.value"} {
+		assert.ErrorAs(t, patch("replace", path, "1"), &err, path)
+		assert.Equal(t, "invalidPath", err.scimType, path)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// traceFlushTimeout bounds exporting the buffered spans on shutdown.
+const traceFlushTimeout = 5 * time.Second
+
+func newHTTPServer(config Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// serve starts serving on listener and returns the channel Serve's error is
+// sent on.
+func serve(server *http.Server, listener net.Listener) <-chan error {
+	served := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			served <- server.ServeTLS(listener, "", "")
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+	slog.Info("listening", "address", listener.Addr().String())
+	return served
+}
+
+// run waits until ctx is done while server, started by serve, serves, and
+// then shuts down gracefully: /readyz starts failing, after ShutdownDelay the
+// listener is closed, requests in flight get until ShutdownTimeout to finish,
+// and finally the database pool is closed and buffered spans are exported.
+// Deleted users are purged in the background while it serves.
+func run(ctx context.Context, s *ServerContext, server *http.Server, served <-chan error) error {
+	purged := make(chan struct{})
+	go func() {
+		purgeDeletedUsers(ctx, s)
+		close(purged)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "delay", s.Config.ShutdownDelay, "timeout", s.Config.ShutdownTimeout)
+	s.Draining.Store(true)
+	// give load balancers time to see the failing readiness probe
+	time.Sleep(s.Config.ShutdownDelay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.Config.ShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("draining connections", "error", err)
+	}
+	if serveErr := <-served; !errors.Is(serveErr, http.ErrServerClosed) {
+		err = errors.Join(err, serveErr)
+	}
+	<-purged
+	if closeErr := s.DB.Close(); closeErr != nil {
+		slog.Error("closing database", "error", closeErr)
+		err = errors.Join(err, closeErr)
+	}
+	if s.TracerProvider != nil {
+		// draining may have used up the shutdown timeout, so the flush gets its own
+		flushCtx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+		defer cancel()
+		if flushErr := s.TracerProvider.Shutdown(flushCtx); flushErr != nil {
+			slog.Error("flushing spans", "error", flushErr)
+			err = errors.Join(err, flushErr)
+		}
+	}
+	slog.Info("shut down")
+	return err
+}
@@ -1,49 +1,337 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/jameshw-dev01/user-api/database"
 	"github.com/jameshw-dev01/user-api/spec"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type ServerContext struct {
-	Users map[string]spec.User
-	DB    spec.DbInterface
+	Users       *userCache
+	DB          spec.DbInterface
+	Config      Config
+	RateLimiter RateLimitStore
+	WebAuthn    *webauthn.WebAuthn
+	Ceremonies  *expiringStore[webauthn.SessionData]
+	Passwords   *Passwords
+	// AuthProvider verifies Basic Auth passwords
+	AuthProvider AuthProvider
+	SigningKey   SigningKey
+	// ConsentTokens maps the token of each OAuth consent page shown to the username
+	ConsentTokens      *expiringStore[string]
+	AuthorizationCodes *expiringStore[authorizationCode]
+	// Exports maps each username to its pending or ready data export
+	Exports *expiringStore[*exportJob]
+	// IdempotencySecret keys the fingerprints of requests with an Idempotency-Key
+	IdempotencySecret []byte
+	Metrics           *Metrics
+	// TracerProvider exports spans; it is nil when tracing is off
+	TracerProvider *sdktrace.TracerProvider
+	// Draining is set on shutdown so readiness probes fail
+	Draining atomic.Bool
 }
 
-func setupRouter(resetDB bool) *gin.Engine {
-	s := ServerContext{Users: make(map[string]spec.User), DB: database.GetDBConnection(resetDB, "PROD")}
+// db returns the database bound to ctx, normally the *gin.Context of the request.
+func (s *ServerContext) db(ctx context.Context) spec.DbInterface {
+	return s.DB.WithContext(ctx)
+}
+
+// newServerContext sets up a server with config, which the caller has loaded
+// and set up logging for, and fills the user cache from db.
+func newServerContext(db spec.DbInterface, config Config) *ServerContext {
+	s := ServerContext{
+		Users:              newUserCache(),
+		DB:                 db,
+		Config:             config,
+		RateLimiter:        newMemoryRateLimitStore(),
+		Ceremonies:         newExpiringStore[webauthn.SessionData](),
+		ConsentTokens:      newExpiringStore[string](),
+		AuthorizationCodes: newExpiringStore[authorizationCode](),
+		Exports:            newExpiringStore[*exportJob](),
+	}
+	var err error
+	s.TracerProvider, err = setupTracing(s.Config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Metrics = newMetrics(&s)
+	s.DB = s.Metrics.instrumentDB(db)
+	s.Passwords, err = newPasswords(s.Config.passwordHasher())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Metrics.instrumentPasswords(s.Passwords)
+	if s.Config.BreachedPasswordsFile != "" {
+		s.Config.PasswordPolicy.Breached, err = loadBreachedPasswordFile(s.Config.BreachedPasswordsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	s.AuthProvider, err = newAuthProvider(s.Config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.SigningKey, err = loadSigningKey(s.Config.OAuthSigningKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.IdempotencySecret = idempotencySecret(s.SigningKey)
+	s.WebAuthn, err = webauthn.New(&webauthn.Config{
+		RPID:          s.Config.WebAuthnRPID,
+		RPDisplayName: "user-api",
+		RPOrigins:     s.Config.WebAuthnOrigins,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 	users, err := s.DB.ReadAll()
 	if err != nil {
 		log.Fatal(err)
 	}
 	for _, u := range users {
-		s.Users[u.Username] = u
+		s.Users.put(u)
 	}
-	router := gin.Default()
+	return &s
+}
+
+func setupRouter(resetDB bool) *gin.Engine {
+	return newRouter(newServerContext(database.GetDBConnection(resetDB, "PROD"), loadConfig()))
+}
+
+func newRouter(s *ServerContext) *gin.Engine {
+	router := gin.New()
+	// lets handlers pass the *gin.Context wherever a context.Context carrying
+	// the request ID is needed
+	router.ContextWithFallback = true
+	router.Use(s.Metrics.middleware(), requestID(), tracing(), requestLogger(), recovery(), hsts(s.Config))
+	router.GET("/metrics", s.Metrics.handler(s.Config.MetricsToken))
+	router.GET("/healthz", healthz)
+	router.GET("/readyz", func(c *gin.Context) { readyz(c, s) })
 	router.SetTrustedProxies(nil)
-	router.POST("/api/v1/user", func(c *gin.Context) { createUser(c, &s) })
+	signupLimit := rateLimit(s, "signup", s.Config.SignupRateLimit)
+	userLimit := rateLimit(s, "user", s.Config.UserRateLimit)
+	router.POST("/api/v1/user", signupLimit, idempotent(s), func(c *gin.Context) { createUser(c, s) })
 	router.GET(
 		"/api/v1/user/:username",
-		func(c *gin.Context) { runAuth(c, &s) },
-		func(c *gin.Context) { getUser(c, &s) },
+		userLimit,
+		authWithScope(s, scopeUsersRead),
+		func(c *gin.Context) { getUser(c, s) },
 	)
 	router.PUT(
 		"/api/v1/user/:username",
-		func(c *gin.Context) { runAuth(c, &s) },
-		func(c *gin.Context) { updateUser(c, &s) },
+		userLimit,
+		authWithScope(s, scopeUsersWrite),
+		func(c *gin.Context) { updateUser(c, s) },
+	)
+	router.PATCH(
+		"/api/v1/user/:username",
+		userLimit,
+		authWithScope(s, scopeUsersWrite),
+		func(c *gin.Context) { patchUser(c, s) },
 	)
 	router.DELETE(
 		"/api/v1/user/:username",
-		func(c *gin.Context) { runAuth(c, &s) },
-		func(c *gin.Context) { deleteUser(c, &s) },
+		userLimit,
+		authWithScope(s, scopeUsersWrite),
+		func(c *gin.Context) { deleteUser(c, s) },
+	)
+	router.POST(
+		"/api/v1/user/:username/export",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { startExport(c, s) },
+	)
+	router.GET(
+		"/api/v1/user/:username/export/:id",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { getExport(c, s) },
+	)
+	router.GET(
+		"/api/v1/user/:username/status",
+		userLimit,
+		func(c *gin.Context) { runAdminAuth(c, s) },
+		func(c *gin.Context) { getStatus(c, s) },
+	)
+	router.PUT(
+		"/api/v1/user/:username/status",
+		userLimit,
+		func(c *gin.Context) { runAdminAuth(c, s) },
+		func(c *gin.Context) { changeStatus(c, s) },
+	)
+	router.POST(
+		"/api/v1/user/:username/restore",
+		userLimit,
+		func(c *gin.Context) { runRestoreAuth(c, s) },
+		func(c *gin.Context) { restoreUser(c, s) },
+	)
+	router.POST(
+		"/api/v1/user/:username/apikeys",
+		userLimit,
+		func(c *gin.Context) { runAuth(c, s) },
+		func(c *gin.Context) { createAPIKey(c, s) },
 	)
+	router.GET(
+		"/api/v1/user/:username/apikeys",
+		userLimit,
+		func(c *gin.Context) { runAuth(c, s) },
+		func(c *gin.Context) { listAPIKeys(c, s) },
+	)
+	router.DELETE(
+		"/api/v1/user/:username/apikeys/:id",
+		userLimit,
+		func(c *gin.Context) { runAuth(c, s) },
+		func(c *gin.Context) { revokeAPIKey(c, s) },
+	)
+	router.PUT(
+		"/api/v1/user/:username/password",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { changePassword(c, s) },
+	)
+	router.POST(
+		"/api/v1/user/:username/password/reset",
+		userLimit,
+		func(c *gin.Context) { runAdminAuth(c, s) },
+		func(c *gin.Context) { issuePasswordReset(c, s) },
+	)
+	router.POST("/api/v1/password/reset", signupLimit, func(c *gin.Context) { resetPassword(c, s) })
+	router.POST(
+		"/api/v1/user/:username/totp",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { enrollTOTP(c, s) },
+	)
+	router.POST(
+		"/api/v1/user/:username/totp/confirm",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { confirmTOTP(c, s) },
+	)
+	router.POST(
+		"/api/v1/user/:username/totp/recovery-codes",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { regenerateRecoveryCodes(c, s) },
+	)
+	router.DELETE(
+		"/api/v1/user/:username/totp",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { disableTOTP(c, s) },
+	)
+	router.POST(
+		"/api/v1/user/:username/session",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { createSession(c, s) },
+	)
+	router.DELETE(
+		"/api/v1/user/:username/session",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { deleteSession(c, s) },
+	)
+	router.GET(
+		"/api/v1/user/:username/logins",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { listLogins(c, s) },
+	)
+	router.POST(
+		"/api/v1/user/:username/passkey/register/begin",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { beginPasskeyRegistration(c, s) },
+	)
+	router.POST(
+		"/api/v1/user/:username/passkey/register/finish",
+		userLimit,
+		func(c *gin.Context) { runSelfAuth(c, s) },
+		func(c *gin.Context) { finishPasskeyRegistration(c, s) },
+	)
+	passkeyLimit := rateLimit(s, "passkey", s.Config.SignupRateLimit)
+	router.POST("/api/v1/passkey/login/begin", passkeyLimit, func(c *gin.Context) { beginPasskeyLogin(c, s) })
+	router.POST("/api/v1/passkey/login/finish", passkeyLimit, func(c *gin.Context) { finishPasskeyLogin(c, s) })
+	router.POST(
+		"/api/v1/oauth/clients",
+		userLimit,
+		func(c *gin.Context) { runAdminAuth(c, s) },
+		func(c *gin.Context) { createOAuthClient(c, s) },
+	)
+	router.POST(
+		"/api/v1/batch",
+		userLimit,
+		func(c *gin.Context) { runAdminAuth(c, s) },
+		func(c *gin.Context) { runBatch(c, s) },
+	)
+	router.GET(
+		"/api/v1/audit",
+		userLimit,
+		func(c *gin.Context) { runAdminAuth(c, s) },
+		func(c *gin.Context) { listAudit(c, s) },
+	)
+	scim := router.Group("/scim/v2", userLimit, func(c *gin.Context) { runSCIMAuth(c, s) })
+	scim.GET("/ServiceProviderConfig", func(c *gin.Context) { scimServiceProviderConfig(c, s) })
+	scim.GET("/Users", func(c *gin.Context) { scimListUsers(c, s) })
+	scim.POST("/Users", func(c *gin.Context) { scimCreateUser(c, s) })
+	scim.GET("/Users/:id", func(c *gin.Context) { scimGetUser(c, s) })
+	scim.PUT("/Users/:id", func(c *gin.Context) { scimReplaceUser(c, s) })
+	scim.PATCH("/Users/:id", func(c *gin.Context) { scimPatchUser(c, s) })
+	scim.DELETE("/Users/:id", func(c *gin.Context) { scimDeleteUser(c, s) })
+	oauthLimit := rateLimit(s, "oauth", s.Config.SignupRateLimit)
+	router.GET("/oauth/authorize", oauthLimit, func(c *gin.Context) { authorize(c, s) })
+	router.POST("/oauth/authorize", oauthLimit, func(c *gin.Context) { submitConsent(c, s) })
+	router.POST("/oauth/token", oauthLimit, func(c *gin.Context) { token(c, s) })
+	router.POST("/oauth/introspect", oauthLimit, func(c *gin.Context) { introspect(c, s) })
+	router.GET("/oauth/userinfo", oauthLimit, func(c *gin.Context) { userinfo(c, s) })
+	router.POST("/oauth/userinfo", oauthLimit, func(c *gin.Context) { userinfo(c, s) })
+	router.GET("/oauth/jwks", func(c *gin.Context) { jwks(c, s) })
+	router.GET("/.well-known/openid-configuration", func(c *gin.Context) { openIDConfiguration(c, s) })
 	return router
 }
 
 func main() {
-	router := setupRouter(false)
-	router.Run()
+	config := loadConfig()
+	setupLogging(config)
+	listener, err := net.Listen("tcp", config.ListenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// listen before connecting so probes can tell a slow start from a dead one
+	handler := newStartupHandler()
+	server := newHTTPServer(config, handler)
+	server.TLSConfig, err = newTLSConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	served := serve(server, listener)
+	db, err := connectWithRetry(ctx, func() (spec.DbInterface, error) {
+		return database.Connect(false, "PROD")
+	}, config.DBConnectTimeout, time.Second)
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := newServerContext(db, config)
+	handler.ready(newRouter(s))
+	err = run(ctx, s, server, served)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -1,13 +1,33 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/database"
+	"github.com/jameshw-dev01/user-api/spec"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestEmailValid(t *testing.T) {
@@ -25,7 +45,7 @@ func TestPostUserSuccess(t *testing.T) {
 	jsonUser, _ := json.Marshal(user)
 
 	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
-	req.SetBasicAuth("john_doe", "pass123")
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusCreated, w.Code)
 	var retrievedUser UserResponse
@@ -34,7 +54,7 @@ func TestPostUserSuccess(t *testing.T) {
 
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
-	req.SetBasicAuth("john_doe", "pass123")
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -51,12 +71,12 @@ func TestPostUserUsernameConflict(t *testing.T) {
 	jsonUser, _ := json.Marshal(user)
 
 	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
-	req.SetBasicAuth("john_doe", "pass123")
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
 	router.ServeHTTP(w, req)
 
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
-	req.SetBasicAuth("john_doe", "pass123")
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
@@ -69,12 +89,12 @@ func TestGetSuccess(t *testing.T) {
 	jsonUser, _ := json.Marshal(user)
 
 	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
-	req.SetBasicAuth("john_doe", "pass123")
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
 	router.ServeHTTP(w, req)
 
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
-	req.SetBasicAuth("john_doe", "pass123")
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -89,7 +109,7 @@ func TestGetAuthWrongPasswordFail(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
-	req.SetBasicAuth("john_doe", "pass123")
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
 	router.ServeHTTP(w, req)
 
 	w = httptest.NewRecorder()
@@ -100,11 +120,55 @@ func TestGetAuthWrongPasswordFail(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
 
+// Unknown usernames must fail exactly like a wrong password
+func TestGetUnknownUserLooksLikeWrongPassword(t *testing.T) {
+	router := setupRouter(true)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/user/nobody", nil)
+	req.SetBasicAuth("nobody", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="user-api"`, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestPostUserUsernameConflictConcealed(t *testing.T) {
+	t.Setenv("SIGNUP_CONFLICT_POLICY", "conceal")
+	router := setupRouter(true)
+	user := UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24}
+	jsonUser, _ := json.Marshal(user)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "another-Secret-9")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// the original password must still be the one that works
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.SetBasicAuth("john_doe", "another-Secret-9")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLoadConfigSignupConflict(t *testing.T) {
+	t.Setenv("SIGNUP_CONFLICT_POLICY", "conceal")
+	assert.Equal(t, SignupConflictConceal, loadConfig().SignupConflict)
+	t.Setenv("SIGNUP_CONFLICT_POLICY", "bogus")
+	assert.Equal(t, SignupConflictReveal, loadConfig().SignupConflict)
+}
+
 func TestGetAuthWrongUserFail(t *testing.T) {
 	user1 := "john_doe"
-	pass1 := "pass1"
+	pass1 := "first-Secret-1"
 	user2 := "jane_doe"
-	pass2 := "pass2"
+	pass2 := "second-Secret-2"
 	jsonUser1, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
 	jsonUser2, _ := json.Marshal(UserResponse{Name: "Jane Doe", Email: "test1@example.com", Age: 26})
 	router := setupRouter(true)
@@ -131,11 +195,11 @@ func TestGetMissingUserFail(t *testing.T) {
 	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
 
 	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
-	req.SetBasicAuth(user1, "pass123")
+	req.SetBasicAuth(user1, "Tr0ub4dor&3")
 	router.ServeHTTP(w, req)
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("GET", "/api/v1/user/"+user2, nil)
-	req.SetBasicAuth(user1, "pass123")
+	req.SetBasicAuth(user1, "Tr0ub4dor&3")
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
@@ -151,18 +215,18 @@ func TestGetFromTwoUsers(t *testing.T) {
 	w := httptest.NewRecorder()
 	jsonUser, _ := json.Marshal(userData1)
 	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
-	req.SetBasicAuth(user1, "pass1")
+	req.SetBasicAuth(user1, "first-Secret-1")
 	router.ServeHTTP(w, req)
 
 	w = httptest.NewRecorder()
 	jsonUser, _ = json.Marshal(userData2)
 	req, _ = http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
-	req.SetBasicAuth(user2, "pass2")
+	req.SetBasicAuth(user2, "second-Secret-2")
 	router.ServeHTTP(w, req)
 
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("GET", "/api/v1/user/"+user1, nil)
-	req.SetBasicAuth(user1, "pass1")
+	req.SetBasicAuth(user1, "first-Secret-1")
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
 	var retrievedUser UserResponse
@@ -174,7 +238,7 @@ func TestGetFromTwoUsers(t *testing.T) {
 func TestUpdateSuccess(t *testing.T) {
 	user1 := "john_doe"
 	userData := UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24}
-	pass1 := "pass1"
+	pass1 := "first-Secret-1"
 	router := setupRouter(true)
 	w := httptest.NewRecorder()
 	jsonUser, _ := json.Marshal(userData)
@@ -209,7 +273,7 @@ func TestUpdateSuccess(t *testing.T) {
 func TestUpdateNoBodyFail(t *testing.T) {
 	user1 := "john_doe"
 	userData := UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24}
-	pass1 := "pass1"
+	pass1 := "first-Secret-1"
 	router := setupRouter(true)
 	w := httptest.NewRecorder()
 	jsonUser, _ := json.Marshal(userData)
@@ -230,7 +294,7 @@ func TestUpdateNoBodyFail(t *testing.T) {
 func TestDeleteSuccess(t *testing.T) {
 	user1 := "john_doe"
 	userData := UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24}
-	pass1 := "pass1"
+	pass1 := "first-Secret-1"
 	router := setupRouter(true)
 	w := httptest.NewRecorder()
 	jsonUser, _ := json.Marshal(userData)
@@ -251,13 +315,13 @@ func TestDeleteSuccess(t *testing.T) {
 	req, _ = http.NewRequest("GET", "/api/v1/user/"+user1, nil)
 	req.SetBasicAuth(user1, pass1)
 	router.ServeHTTP(w, req)
-	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
 
 func TestDeleteFailNoEffect(t *testing.T) {
 	user1 := "john_doe"
 	userData := UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24}
-	pass1 := "pass1"
+	pass1 := "first-Secret-1"
 	router := setupRouter(true)
 	w := httptest.NewRecorder()
 	jsonUser, _ := json.Marshal(userData)
@@ -284,3 +348,1420 @@ func TestDeleteFailNoEffect(t *testing.T) {
 	json.Unmarshal(w.Body.Bytes(), &retrievedUser)
 	assert.Equal(t, userData, retrievedUser)
 }
+
+func TestParseRateLimitRule(t *testing.T) {
+	rule, err := parseRateLimitRule("10/1m")
+	assert.Nil(t, err)
+	assert.Equal(t, RateLimitRule{Limit: 10, Period: time.Minute}, rule)
+	rule, err = parseRateLimitRule("off")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, rule.Limit)
+	_, err = parseRateLimitRule("10")
+	assert.NotNil(t, err)
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	rule := RateLimitRule{Limit: 2, Period: 2 * time.Second}
+	now := time.Now()
+	first, _ := store.Take("a", rule, now)
+	second, _ := store.Take("a", rule, now)
+	third, _ := store.Take("a", rule, now)
+	assert.True(t, first.Allowed)
+	assert.Equal(t, 1, first.Remaining)
+	assert.True(t, second.Allowed)
+	assert.False(t, third.Allowed)
+	assert.Equal(t, time.Second, third.RetryAfter)
+	// buckets are independent per key
+	other, _ := store.Take("b", rule, now)
+	assert.True(t, other.Allowed)
+	// one token is back after a second
+	later, _ := store.Take("a", rule, now.Add(time.Second))
+	assert.True(t, later.Allowed)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	s := ServerContext{RateLimiter: newMemoryRateLimitStore()}
+	router := gin.New()
+	limit := RouteRateLimit{Rule: RateLimitRule{Limit: 1, Period: time.Minute}, Key: "ip"}
+	router.GET("/", rateLimit(&s, "test", limit), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
+
+func TestRateLimitByAPIKeyWithoutKey(t *testing.T) {
+	s := ServerContext{RateLimiter: newMemoryRateLimitStore()}
+	router := gin.New()
+	limit := RouteRateLimit{Rule: RateLimitRule{Limit: 1, Period: time.Minute}, Key: "apikey"}
+	router.GET("/", rateLimit(&s, "test", limit), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "request without an API key not limited")
+}
+
+func TestRateLimitByUsername(t *testing.T) {
+	s := ServerContext{RateLimiter: newMemoryRateLimitStore()}
+	router := gin.New()
+	limit := RouteRateLimit{Rule: RateLimitRule{Limit: 1, Period: time.Minute}, Key: "username"}
+	router.GET("/", rateLimit(&s, "test", limit), func(c *gin.Context) { c.Status(http.StatusOK) })
+	send := func(username string, ip string) int {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(username, "wrong")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, send("john_doe", "192.0.2.1"))
+	assert.Equal(t, http.StatusTooManyRequests, send("john_doe", "192.0.2.1"))
+	// another client cannot use up the bucket of john_doe
+	assert.Equal(t, http.StatusOK, send("john_doe", "192.0.2.2"))
+}
+
+func TestTOTPRFC6238Vector(t *testing.T) {
+	key := []byte("12345678901234567890")
+	// RFC 6238 gives 94287082 for T=59, of which the last six digits are the code
+	assert.Equal(t, "287082", hotp(key, 59/totpPeriod))
+	secret := totpEncoding.EncodeToString(key)
+	step, valid := verifyTOTP(secret, "287082", time.Unix(59, 0))
+	assert.True(t, valid)
+	assert.Equal(t, int64(59/totpPeriod), step)
+	step, valid = verifyTOTP(secret, "287082", time.Unix(59+totpPeriod, 0))
+	assert.True(t, valid)
+	assert.Equal(t, int64(59/totpPeriod), step)
+	_, valid = verifyTOTP(secret, "287082", time.Unix(59+3*totpPeriod, 0))
+	assert.False(t, valid)
+	_, valid = verifyTOTP(secret, "28708", time.Unix(59, 0))
+	assert.False(t, valid)
+}
+
+func TestRecoveryCodesHashed(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	assert.Nil(t, err)
+	assert.Len(t, codes, recoveryCodeCount)
+	assert.NotEqual(t, codes[0], hashes[0])
+	assert.Equal(t, hashes[0], hashRecoveryCode(strings.ToUpper(codes[0])))
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	router := setupRouter(true)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/totp", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var enrollment TOTPEnrollment
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/")
+
+	key, _ := totpEncoding.DecodeString(enrollment.Secret)
+	code := hotp(key, uint64(time.Now().Unix()/totpPeriod))
+	jsonCode, _ := json.Marshal(TOTPCode{Code: code})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/totp/confirm", strings.NewReader(string(jsonCode)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var recovery RecoveryCodes
+	json.Unmarshal(w.Body.Bytes(), &recovery)
+
+	// password alone is no longer enough
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// the code used to confirm cannot be used again, but the next one can, once
+	w = httptest.NewRecorder()
+	req.Header.Set("X-TOTP-Code", code)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = httptest.NewRecorder()
+	req.Header.Set("X-TOTP-Code", hotp(key, uint64(time.Now().Unix()/totpPeriod+1)))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "totp code replayed")
+
+	// recovery codes work exactly once
+	req.Header.Del("X-TOTP-Code")
+	req.Header.Set("X-Recovery-Code", recovery.RecoveryCodes[0])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestTOTPChangesNeedReauthentication(t *testing.T) {
+	router := setupRouter(true)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/totp", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	var enrollment TOTPEnrollment
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	key, _ := totpEncoding.DecodeString(enrollment.Secret)
+	step := uint64(time.Now().Unix() / totpPeriod)
+	jsonCode, _ := json.Marshal(TOTPCode{Code: hotp(key, step)})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/totp/confirm", strings.NewReader(string(jsonCode)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/session", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	req.Header.Set("X-TOTP-Code", hotp(key, step+1))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var session SessionResponse
+	json.Unmarshal(w.Body.Bytes(), &session)
+
+	send := func(method string, path string, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	// a session token alone cannot replace the recovery codes or remove the factor
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/v1/user/john_doe/totp/recovery-codes", ""))
+	assert.Equal(t, http.StatusUnauthorized, send("DELETE", "/api/v1/user/john_doe/totp", ""))
+	assert.Equal(t, http.StatusForbidden, send("DELETE", "/api/v1/user/john_doe/totp", `{"current_password": "wrong"}`))
+	assert.Equal(t, http.StatusOK, send("POST", "/api/v1/user/john_doe/totp/recovery-codes", `{"current_password": "Tr0ub4dor&3"}`))
+	assert.Equal(t, http.StatusNoContent, send("DELETE", "/api/v1/user/john_doe/totp", `{"current_password": "Tr0ub4dor&3"}`))
+}
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher := argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	hash, err := hasher.Hash("Tr0ub4dor&3")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	ok, err := hasher.Verify(hash, "Tr0ub4dor&3")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = hasher.Verify(hash, "wrong")
+	assert.False(t, ok)
+	assert.False(t, hasher.NeedsRehash(hash))
+	hasher.Iterations = 2
+	assert.True(t, hasher.NeedsRehash(hash))
+
+	// parameters argon2id cannot be verified with are errors, not panics
+	salt, key := "c29tZXNhbHRzb21lc2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	for _, params := range []string{"m=0,t=0,p=0", "m=1024,t=1,p=0", "m=1024,t=0,p=1", "m=4294967295,t=1,p=1", "m=1024,t=1000,p=1"} {
+		encoded := "$argon2id$v=19$" + params + "$" + salt + "$" + key
+		assert.NotNil(t, hasher.Check(encoded), params)
+		assert.NotPanics(t, func() {
+			_, err = hasher.Verify(encoded, "Tr0ub4dor&3")
+		}, params)
+		assert.NotNil(t, err, params)
+	}
+	assert.NotNil(t, hasher.Check("$argon2id$v=19$m=1024,t=1,p=1$$"+key), "empty salt")
+	assert.Nil(t, hasher.Check(hash))
+	assert.Nil(t, argon2idHasher{}.Check("$argon2id$v=19$m=1024,t=1,p=1$"+salt+"$"+key))
+}
+
+func TestPasswordsRehashOnAlgorithmChange(t *testing.T) {
+	old, _ := newPasswords(bcryptHasher{Cost: bcrypt.MinCost})
+	hash, _ := old.Hash(context.Background(), "Tr0ub4dor&3")
+	ok, rehash, err := old.Verify(context.Background(), hash, "Tr0ub4dor&3")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, rehash)
+
+	current, _ := newPasswords(argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	ok, rehash, _ = current.Verify(context.Background(), hash, "Tr0ub4dor&3")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+	ok, rehash, _ = current.Verify(context.Background(), hash, "wrong")
+	assert.False(t, ok)
+	assert.False(t, rehash)
+	_, _, err = current.Verify(context.Background(), "plaintext", "Tr0ub4dor&3")
+	assert.NotNil(t, err)
+}
+
+func TestPasswordScore(t *testing.T) {
+	assert.Equal(t, 0, passwordScore("password1"))
+	assert.Equal(t, 0, passwordScore("aaaaaaaaaaaa"))
+	assert.Less(t, passwordScore("abcdefgh12345"), 2)
+	assert.Equal(t, 4, passwordScore("Tr0ub4dor&3"))
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := defaultConfig().PasswordPolicy
+	errs, err := policy.Check("john_doe", "")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, errs)
+	errs, _ = policy.Check("john_doe", "my-john_doe-Secret")
+	assert.Equal(t, []FieldError{{Field: "password", Message: "must not contain the username"}}, errs)
+	errs, _ = policy.Check("john_doe", "Tr0ub4dor&3")
+	assert.Empty(t, errs)
+	policy.MinClasses = 4
+	errs, _ = policy.Check("john_doe", "correct horse battery")
+	assert.Len(t, errs, 1)
+}
+
+func TestBreachedPasswordFile(t *testing.T) {
+	path := t.TempDir() + "/breached.txt"
+	// SHA-1 of "Tr0ub4dor&3"
+	sum := sha1.Sum([]byte("Tr0ub4dor&3"))
+	os.WriteFile(path, []byte(hex.EncodeToString(sum[:])+":42\n"), 0o600)
+	breached, err := loadBreachedPasswordFile(path)
+	assert.Nil(t, err)
+	found, _ := isBreached(breached, "Tr0ub4dor&3")
+	assert.True(t, found)
+	found, _ = isBreached(breached, "correct horse battery")
+	assert.False(t, found)
+
+	policy := defaultConfig().PasswordPolicy
+	policy.Breached = breached
+	errs, _ := policy.Check("john_doe", "Tr0ub4dor&3")
+	assert.Equal(t, []FieldError{{Field: "password", Message: "has appeared in a data breach"}}, errs)
+}
+
+func TestPostUserWeakPasswordFail(t *testing.T) {
+	router := setupRouter(true)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var errs ValidationErrors
+	json.Unmarshal(w.Body.Bytes(), &errs)
+	assert.NotEmpty(t, errs.Errors)
+	assert.Equal(t, "password", errs.Errors[0].Field)
+}
+
+func TestChangePassword(t *testing.T) {
+	router := setupRouter(true)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/api/v1/user/john_doe/password", strings.NewReader(`{"password": "short"}`))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/api/v1/user/john_doe/password", strings.NewReader(`{"password": "correct horse battery"}`))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.SetBasicAuth("john_doe", "correct horse battery")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestChangePasswordWithSession(t *testing.T) {
+	router := setupRouter(true)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	var sessions [2]SessionResponse
+	for i := range sessions {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/session", nil)
+		req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+		router.ServeHTTP(w, req)
+		json.Unmarshal(w.Body.Bytes(), &sessions[i])
+	}
+	send := func(token string, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/api/v1/user/john_doe/password", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// a stolen session token alone cannot take over the account
+	assert.Equal(t, http.StatusBadRequest, send(sessions[0].Token, `{"password": "correct horse battery"}`))
+	assert.Equal(t, http.StatusForbidden, send(sessions[0].Token, `{"password": "correct horse battery", "current_password": "wrong"}`))
+	assert.Equal(t, http.StatusNoContent, send(sessions[0].Token, `{"password": "correct horse battery", "current_password": "Tr0ub4dor&3"}`))
+
+	// the other sessions are revoked, the one used to change it is kept
+	for i, expected := range []int{http.StatusOK, http.StatusUnauthorized} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+		req.Header.Set("Authorization", "Bearer "+sessions[i].Token)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, expected, w.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	send := func(method string, path string, username string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		if username != "" {
+			req.SetBasicAuth(username, "Tr0ub4dor&3")
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	jsonUser, _ := json.Marshal(UserResponse{Name: "Someone", Email: "test@example.com", Age: 24})
+	send("POST", "/api/v1/user", "john_doe", string(jsonUser))
+	send("POST", "/api/v1/user", "jane_smith", string(jsonUser))
+	admin := s.Users.get("john_doe")
+	admin.Admin = true
+	s.DB.Update(admin)
+	admin.Version++
+	s.Users.put(admin)
+	w := send("POST", "/api/v1/user/jane_smith/session", "jane_smith", "")
+	var session SessionResponse
+	json.Unmarshal(w.Body.Bytes(), &session)
+
+	assert.Equal(t, http.StatusForbidden, send("POST", "/api/v1/user/jane_smith/password/reset", "jane_smith", "").Code)
+	w = send("POST", "/api/v1/user/jane_smith/password/reset", "john_doe", "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var reset PasswordResetToken
+	json.Unmarshal(w.Body.Bytes(), &reset)
+	assert.WithinDuration(t, time.Now().Add(s.Config.PasswordResetTTL), reset.ExpiresAt, time.Minute)
+
+	body := func(username string, token string, password string) string {
+		data, _ := json.Marshal(PasswordReset{Username: username, Token: token, Password: password})
+		return string(data)
+	}
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/v1/password/reset", "", body("jane_smith", reset.Token, "short")).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/v1/password/reset", "", body("jane_smith", "wrong", "correct horse battery")).Code)
+	assert.Equal(t, http.StatusNoContent, send("POST", "/api/v1/password/reset", "", body("jane_smith", reset.Token, "correct horse battery")).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/v1/password/reset", "", body("jane_smith", reset.Token, "another horse battery")).Code, "token reused")
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/user/jane_smith", nil)
+	req.SetBasicAuth("jane_smith", "correct horse battery")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/jane_smith", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "session kept after reset")
+}
+
+func TestParseAPIKey(t *testing.T) {
+	key, id, err := newAPIKey()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(key, apiKeyPrefix))
+	parsed, ok := parseAPIKey(key)
+	assert.True(t, ok)
+	assert.Equal(t, id, parsed)
+	_, ok = parseAPIKey("Tr0ub4dor&3")
+	assert.False(t, ok)
+}
+
+func TestAPIKeyNeedsReauthentication(t *testing.T) {
+	router := setupRouter(true)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/session", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	var session SessionResponse
+	json.Unmarshal(w.Body.Bytes(), &session)
+	send := func(body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/user/john_doe/apikeys", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, send(`{"name": "reporting", "scopes": ["users:read"]}`))
+	assert.Equal(t, http.StatusForbidden, send(`{"name": "reporting", "scopes": ["users:read"], "current_password": "wrong"}`))
+	assert.Equal(t, http.StatusCreated, send(`{"name": "reporting", "scopes": ["users:read"], "current_password": "Tr0ub4dor&3"}`))
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	router := setupRouter(true)
+	userData := UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24}
+	jsonUser, _ := json.Marshal(userData)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/apikeys", strings.NewReader(`{"name": "reporting", "scopes": ["users:read"]}`))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created APIKeyResponse
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.Header.Set("X-API-Key", created.Key)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var retrievedUser UserResponse
+	json.Unmarshal(w.Body.Bytes(), &retrievedUser)
+	assert.Equal(t, userData, retrievedUser)
+
+	// the key is read only
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/v1/user/john_doe", nil)
+	req.Header.Set("X-API-Key", created.Key)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// listing never shows the key itself
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe/apikeys", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), created.Key)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/v1/user/john_doe/apikeys/"+created.ID, nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.Header.Set("X-API-Key", created.Key)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRequestLogging(t *testing.T) {
+	router := setupRouter(true)
+	var logs strings.Builder
+	slog.SetDefault(newLogger(defaultConfig(), &logs))
+	defer slog.SetDefault(newLogger(defaultConfig(), os.Stderr))
+	userData := UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24}
+	jsonUser, _ := json.Marshal(userData)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	req.Header.Set("X-Request-ID", "req-42")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "req-42", w.Header().Get("X-Request-ID"))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.SetBasicAuth("john_doe", "wrong-Password-1")
+	req.Header.Set("X-Request-ID", "not a valid id\n")
+	router.ServeHTTP(w, req)
+	generated := w.Header().Get("X-Request-ID")
+	assert.Len(t, generated, 32)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Len(t, lines, 2)
+	var entry map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &entry)
+	assert.Equal(t, "req-42", entry["request_id"])
+	assert.Equal(t, float64(http.StatusCreated), entry["status"])
+	assert.Equal(t, "/api/v1/user", entry["route"])
+	json.Unmarshal([]byte(lines[1]), &entry)
+	assert.Equal(t, generated, entry["request_id"])
+	assert.Equal(t, "WARN", entry["level"])
+	assert.NotContains(t, logs.String(), "Tr0ub4dor")
+	assert.NotContains(t, logs.String(), "wrong-Password-1")
+	assert.NotContains(t, logs.String(), "$2a$")
+}
+
+func TestMetrics(t *testing.T) {
+	t.Setenv("METRICS_TOKEN", "scrape-secret")
+	router := setupRouter(true)
+	userData := UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24}
+	jsonUser, _ := json.Marshal(userData)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	w = httptest.NewRecorder()
+	req.SetBasicAuth("john_doe", "wrong-Password-1")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer scrape-secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	metrics := w.Body.String()
+	assert.Contains(t, metrics, `userapi_http_requests_total{method="GET",route="/api/v1/user/:username",status="200"} 1`)
+	assert.Contains(t, metrics, `userapi_http_requests_total{method="GET",route="/api/v1/user/:username",status="401"} 1`)
+	assert.Contains(t, metrics, `userapi_auth_attempts_total{method="password",outcome="failure"} 1`)
+	assert.Contains(t, metrics, `userapi_auth_attempts_total{method="password",outcome="success"} 1`)
+	assert.Contains(t, metrics, `userapi_db_operation_duration_seconds_count{operation="Create"} 1`)
+	assert.Contains(t, metrics, `userapi_user_cache_size 1`)
+	assert.Regexp(t, `userapi_user_cache_lookups_total\{result="hit"\} [1-9]`, metrics)
+	assert.Regexp(t, `userapi_user_cache_lookups_total\{result="miss"\} [1-9]`, metrics)
+	assert.Contains(t, metrics, `userapi_password_hash_duration_seconds_count{algorithm="bcrypt",operation="verify"} 2`)
+
+	// without a token only local clients may scrape
+	t.Setenv("METRICS_TOKEN", "")
+	router = setupRouter(true)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = httptest.NewRecorder()
+	req.RemoteAddr = "127.0.0.1:9100"
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestTracing(t *testing.T) {
+	router := setupRouter(true)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	userData := UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24}
+	jsonUser, _ := json.Marshal(userData)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/api/v1/user/john_doe", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == "4bf92f3577b34da6a3ce929d0e0e4736" {
+			spans[span.Name()] = span
+		}
+	}
+	server := spans["PUT /api/v1/user/:username"]
+	if assert.NotNil(t, server) {
+		assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+		assert.Equal(t, spans["authenticate"].Parent().SpanID(), server.SpanContext().SpanID())
+		assert.Equal(t, spans["password.verify"].Parent().SpanID(), spans["authenticate"].SpanContext().SpanID())
+		assert.Equal(t, spans["db.UpdateFields"].Parent().SpanID(), server.SpanContext().SpanID())
+	}
+}
+
+type unreachableDB struct {
+	spec.DbInterface
+}
+
+func (db unreachableDB) WithContext(ctx context.Context) spec.DbInterface {
+	return db
+}
+
+func (db unreachableDB) Ping() error {
+	return errors.New("connection refused")
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var readiness ReadinessResponse
+	json.Unmarshal(w.Body.Bytes(), &readiness)
+	assert.Equal(t, "ok", readiness.Status)
+	assert.Equal(t, "ok", readiness.Checks["migrations"].Status)
+
+	s.DB = unreachableDB{s.DB}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &readiness)
+	assert.Equal(t, "unavailable", readiness.Status)
+	assert.Equal(t, HealthCheck{Status: "fail", Error: "connection refused"}, readiness.Checks["database"])
+
+	// liveness does not depend on the database
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/healthz", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestStartupHandler(t *testing.T) {
+	handler := newStartupHandler()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var readiness ReadinessResponse
+	json.Unmarshal(w.Body.Bytes(), &readiness)
+	assert.Equal(t, "fail", readiness.Checks["database"].Status)
+	assert.Equal(t, "fail", readiness.Checks["cache"].Status)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	handler.ready(setupRouter(true))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	attempts := 0
+	connect := func() (spec.DbInterface, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return unreachableDB{}, nil
+	}
+	db, err := connectWithRetry(context.Background(), connect, time.Second, time.Millisecond)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	assert.Equal(t, 3, attempts)
+
+	attempts = -100
+	_, err = connectWithRetry(context.Background(), connect, 10*time.Millisecond, time.Millisecond)
+	assert.ErrorContains(t, err, "connection refused")
+	assert.Less(t, attempts, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = connectWithRetry(ctx, connect, time.Minute, time.Second)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	started := make(chan struct{})
+	router.GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		server := newHTTPServer(s.Config, router)
+		stopped <- run(ctx, s, server, serve(server, listener))
+	}()
+
+	url := "http://" + listener.Addr().String()
+	response := make(chan int)
+	go func() {
+		res, err := http.Get(url + "/slow")
+		if err != nil {
+			response <- 0
+			return
+		}
+		res.Body.Close()
+		response <- res.StatusCode
+	}()
+	<-started
+	cancel()
+	// the request in flight completes before run returns
+	assert.Equal(t, http.StatusOK, <-response)
+	assert.Nil(t, <-stopped)
+	assert.True(t, s.Draining.Load())
+	_, err = http.Get(url + "/healthz")
+	assert.NotNil(t, err)
+}
+
+func TestAuditLog(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	for _, username := range []string{"john_doe", "jane_smith"} {
+		jsonUser, _ := json.Marshal(UserResponse{Name: "Someone", Email: "test@example.com", Age: 24})
+		req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+		req.SetBasicAuth(username, "Tr0ub4dor&3")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	admin := s.Users.get("john_doe")
+	admin.Admin = true
+	s.DB.Update(admin)
+	s.Users.put(admin)
+
+	jsonUser, _ := json.Marshal(UserResponse{Name: "Jane Smith", Email: "test@example.com", Age: 24})
+	req, _ := http.NewRequest("PUT", "/api/v1/user/jane_smith", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	req.Header.Set(requestIDHeader, "update-jane")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest("PUT", "/api/v1/user/jane_smith/password", strings.NewReader(`{"password": "another-Secret-9"}`))
+	req.SetBasicAuth("jane_smith", "Tr0ub4dor&3")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/audit?username=jane_smith", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), s.Users.get("jane_smith").Hash)
+	var entries []AuditEntryResponse
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	if len(entries) != 3 {
+		t.Fatalf("got %d audit entries, want 3", len(entries))
+	}
+	assert.Equal(t, auditPasswordChange, entries[0].Action)
+	assert.Equal(t, []spec.FieldChange{{Field: "password"}}, entries[0].Changes)
+	assert.Equal(t, "jane_smith", entries[0].Actor)
+	assert.Equal(t, auditUserUpdate, entries[1].Action)
+	assert.Equal(t, "john_doe", entries[1].Actor)
+	assert.Equal(t, "jane_smith", entries[1].Target)
+	assert.Equal(t, "update-jane", entries[1].RequestID)
+	assert.Equal(t, []spec.FieldChange{{Field: "name", Before: "Someone", After: "Jane Smith"}}, entries[1].Changes)
+	assert.Equal(t, auditUserCreate, entries[2].Action)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/audit?username=jane_smith&since="+time.Now().Add(time.Hour).Format(time.RFC3339), nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "[]", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/audit?since=yesterday", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/audit?username=jane_smith", nil)
+	req.SetBasicAuth("jane_smith", "another-Secret-9")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestLoginHistory(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	for _, username := range []string{"john_doe", "jane_smith"} {
+		jsonUser, _ := json.Marshal(UserResponse{Name: "Someone", Email: "test@example.com", Age: 24})
+		req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+		req.SetBasicAuth(username, "Tr0ub4dor&3")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req, _ := http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.SetBasicAuth("john_doe", "wrong-Password-1")
+	req.Header.Set("User-Agent", "attacker/1.0")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	// unknown usernames have no history to add to
+	req.SetBasicAuth("nobody", "wrong-Password-1")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	// every successful authentication with Basic Auth is recorded once,
+	// including the one creating a session
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/session", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	req.Header.Set("User-Agent", "browser/2.0")
+	req.RemoteAddr = "192.0.2.1:1234"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe/logins?limit=5", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	req.Header.Set("User-Agent", "cli/3.0")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var attempts []LoginAttemptResponse
+	json.Unmarshal(w.Body.Bytes(), &attempts)
+	if len(attempts) != 3 {
+		t.Fatalf("got %d login attempts, want 3", len(attempts))
+	}
+	assert.Equal(t, loginSuccess, attempts[0].Outcome)
+	assert.Equal(t, "cli/3.0", attempts[0].UserAgent)
+	assert.Equal(t, loginSuccess, attempts[1].Outcome)
+	assert.Equal(t, "browser/2.0", attempts[1].UserAgent)
+	assert.Equal(t, "192.0.2.1", attempts[1].IP)
+	assert.Equal(t, "password", attempts[1].Method)
+	assert.Equal(t, loginInvalidCredentials, attempts[2].Outcome)
+	assert.Equal(t, "attacker/1.0", attempts[2].UserAgent)
+	remaining, _ := s.DB.ReadLoginAttempts("nobody", 0)
+	assert.Empty(t, remaining)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe/logins", nil)
+	req.SetBasicAuth("jane_smith", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	s.Config.LoginHistoryRetention = 0
+	pruneLoginHistory(context.Background(), s)
+	remaining, _ = s.DB.ReadLoginAttempts("john_doe", 0)
+	assert.Empty(t, remaining)
+}
+
+// failingDeleteDB fails every Delete, inside transactions too.
+type failingDeleteDB struct {
+	spec.DbInterface
+}
+
+func (db failingDeleteDB) Transaction(fn func(tx spec.DbInterface) error) error {
+	return db.DbInterface.Transaction(func(tx spec.DbInterface) error {
+		return fn(failingDeleteDB{tx})
+	})
+}
+
+func (db failingDeleteDB) Delete(user spec.User) error {
+	return errors.New("connection reset")
+}
+
+func TestSoftDeleteIsAtomic(t *testing.T) {
+	db := database.GetDBConnection(true, "PROD")
+	user := spec.User{Username: "john_doe", Name: "John Doe", Email: "test@example.com", Status: spec.StatusActive}
+	db.Create(user)
+	_, err := softDelete(failingDeleteDB{db}, user, "")
+	assert.NotNil(t, err)
+	stored, err := db.Read("john_doe")
+	assert.Nil(t, err)
+	assert.Equal(t, spec.StatusActive, stored.Status)
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	send := func(method string, path string, username string, password string) *httptest.ResponseRecorder {
+		jsonUser, _ := json.Marshal(UserResponse{Name: "Someone", Email: "test@example.com", Age: 24})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(string(jsonUser)))
+		req.SetBasicAuth(username, password)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	send("POST", "/api/v1/user", "john_doe", "Tr0ub4dor&3")
+	send("POST", "/api/v1/user", "jane_smith", "Tr0ub4dor&3")
+	admin := s.Users.get("jane_smith")
+	admin.Admin = true
+	s.DB.Update(admin)
+	s.Users.put(admin)
+
+	assert.Equal(t, http.StatusOK, send("DELETE", "/api/v1/user/john_doe", "john_doe", "Tr0ub4dor&3").Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/v1/user/john_doe", "john_doe", "Tr0ub4dor&3").Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/v1/user", "john_doe", "Tr0ub4dor&3").Code, "username of deleted user reused")
+
+	// self-service restore with the old password
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/v1/user/john_doe/restore", "john_doe", "wrong-Password-1").Code)
+	assert.Equal(t, http.StatusOK, send("POST", "/api/v1/user/john_doe/restore", "john_doe", "Tr0ub4dor&3").Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/v1/user/john_doe", "john_doe", "Tr0ub4dor&3").Code)
+	assert.Equal(t, http.StatusNotFound, send("POST", "/api/v1/user/john_doe/restore", "jane_smith", "Tr0ub4dor&3").Code)
+
+	// admin restore
+	send("DELETE", "/api/v1/user/john_doe", "john_doe", "Tr0ub4dor&3")
+	assert.Equal(t, http.StatusOK, send("POST", "/api/v1/user/john_doe/restore", "jane_smith", "Tr0ub4dor&3").Code)
+
+	// a restore keeps the status the user had, so it does not lift a suspension
+	suspend := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/api/v1/user/john_doe/status", strings.NewReader(`{"status": "suspended", "reason": "chargeback"}`))
+	req.SetBasicAuth("jane_smith", "Tr0ub4dor&3")
+	router.ServeHTTP(suspend, req)
+	assert.Equal(t, http.StatusOK, suspend.Code)
+	assert.Equal(t, http.StatusOK, send("DELETE", "/api/v1/user/john_doe", "jane_smith", "Tr0ub4dor&3").Code)
+	assert.Equal(t, http.StatusOK, send("POST", "/api/v1/user/john_doe/restore", "john_doe", "Tr0ub4dor&3").Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/v1/user/john_doe", "john_doe", "Tr0ub4dor&3").Code)
+	restored := s.Users.get("john_doe")
+	assert.Equal(t, spec.StatusSuspended, restored.Status)
+	assert.Equal(t, "chargeback", restored.StatusReason)
+	assert.Equal(t, "", restored.PreviousStatus)
+	stored, _ := s.DB.Read("john_doe")
+	assert.Equal(t, spec.StatusSuspended, stored.Status)
+	restored.Status = spec.StatusActive
+	s.DB.UpdateStatus(restored)
+	restored.Version++
+	s.Users.put(restored)
+
+	// after the grace period the user can no longer be restored and is purged
+	send("DELETE", "/api/v1/user/john_doe", "john_doe", "Tr0ub4dor&3")
+	s.Config.DeletionGracePeriod = 0
+	assert.Equal(t, http.StatusGone, send("POST", "/api/v1/user/john_doe/restore", "jane_smith", "Tr0ub4dor&3").Code)
+	purgeExpiredUsers(context.Background(), s)
+	assert.Equal(t, http.StatusNotFound, send("POST", "/api/v1/user/john_doe/restore", "jane_smith", "Tr0ub4dor&3").Code)
+	assert.Equal(t, http.StatusCreated, send("POST", "/api/v1/user", "john_doe", "another-Secret-9").Code)
+}
+
+func TestDataExport(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	send := func(method string, path string) *httptest.ResponseRecorder {
+		jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(string(jsonUser)))
+		req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	send("POST", "/api/v1/user")
+	send("POST", "/api/v1/user/john_doe/session")
+
+	w := send("POST", "/api/v1/user/john_doe/export")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `attachment; filename="john_doe-export.json"`, w.Header().Get("Content-Disposition"))
+	assert.NotContains(t, w.Body.String(), s.Users.get("john_doe").Hash)
+	var export DataExport
+	json.Unmarshal(w.Body.Bytes(), &export)
+	assert.Equal(t, "test@example.com", export.Profile.Email)
+	assert.Equal(t, spec.StatusActive, export.Profile.Status)
+	assert.Equal(t, 1, len(export.Sessions))
+	// creating the session and requesting the export
+	assert.Equal(t, 2, len(export.LoginHistory))
+	assert.Equal(t, auditUserCreate, export.AuditLog[0].Action)
+
+	w = send("POST", "/api/v1/user/john_doe/export?format=zip")
+	assert.Equal(t, http.StatusOK, w.Code)
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "john_doe.json", archive.File[0].Name)
+
+	// exports that take longer than ExportWait finish in the background
+	s.Config.ExportWait = 0
+	w = send("POST", "/api/v1/user/john_doe/export")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	location := w.Header().Get("Location")
+	for i := 0; i < 100 && w.Code == http.StatusAccepted; i++ {
+		time.Sleep(10 * time.Millisecond)
+		w = send("GET", location)
+	}
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &export)
+	assert.Equal(t, "john_doe", export.Profile.Username)
+
+	// only one export per user is kept until it expires
+	w = send("POST", "/api/v1/user/john_doe/export")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, location, w.Header().Get("Location"))
+	s.Exports.take("john_doe")
+	assert.Equal(t, http.StatusAccepted, send("POST", "/api/v1/user/john_doe/export").Code)
+	assert.Equal(t, http.StatusNotFound, send("GET", "/api/v1/user/john_doe/export/unknown").Code)
+}
+
+func TestAccountStatus(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	send := func(method string, path string, username string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth(username, "Tr0ub4dor&3")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	jsonUser, _ := json.Marshal(UserResponse{Name: "Someone", Email: "test@example.com", Age: 24})
+	send("POST", "/api/v1/user", "john_doe", string(jsonUser))
+	send("POST", "/api/v1/user", "jane_smith", string(jsonUser))
+	admin := s.Users.get("john_doe")
+	admin.Admin = true
+	s.DB.Update(admin)
+	s.Users.put(admin)
+	w := send("POST", "/api/v1/user/jane_smith/session", "jane_smith", "")
+	var session SessionResponse
+	json.Unmarshal(w.Body.Bytes(), &session)
+
+	assert.Equal(t, http.StatusBadRequest, send("PUT", "/api/v1/user/jane_smith/status", "john_doe", `{"status": "suspended"}`).Code, "suspended without a reason")
+	assert.Equal(t, http.StatusOK, send("PUT", "/api/v1/user/jane_smith/status", "john_doe", `{"status": "suspended", "reason": "chargeback"}`).Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/v1/user/jane_smith", "jane_smith", "").Code)
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/user/jane_smith", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code, "session of suspended user accepted")
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/v1/user/jane_smith/status", "jane_smith", "").Code)
+
+	w = send("GET", "/api/v1/user/jane_smith/status", "john_doe", "")
+	var status StatusResponse
+	json.Unmarshal(w.Body.Bytes(), &status)
+	assert.Equal(t, spec.StatusSuspended, status.Status)
+	assert.Equal(t, "chargeback", status.Reason)
+	assert.WithinDuration(t, time.Now(), status.ChangedAt, time.Minute)
+
+	assert.Equal(t, http.StatusConflict, send("PUT", "/api/v1/user/jane_smith/status", "john_doe", `{"status": "locked", "reason": "x"}`).Code)
+	assert.Equal(t, http.StatusOK, send("PUT", "/api/v1/user/jane_smith/status", "john_doe", `{"status": "active"}`).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/v1/user/jane_smith", "jane_smith", "").Code)
+
+	// deleting through the status soft-deletes, and activating restores
+	assert.Equal(t, http.StatusOK, send("PUT", "/api/v1/user/jane_smith/status", "john_doe", `{"status": "deleted"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/v1/user/jane_smith", "jane_smith", "").Code)
+	json.Unmarshal(send("GET", "/api/v1/user/jane_smith/status", "john_doe", "").Body.Bytes(), &status)
+	assert.Equal(t, spec.StatusDeleted, status.Status)
+	assert.Equal(t, http.StatusOK, send("PUT", "/api/v1/user/jane_smith/status", "john_doe", `{"status": "active"}`).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/v1/user/jane_smith", "jane_smith", "").Code)
+
+	// new users wait for an admin when signups are pending
+	s.Config.SignupStatus = spec.StatusPending
+	send("POST", "/api/v1/user", "jim_doe", string(jsonUser))
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/v1/user/jim_doe", "jim_doe", "").Code)
+	assert.Equal(t, http.StatusOK, send("PUT", "/api/v1/user/jim_doe/status", "john_doe", `{"status": "active"}`).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/v1/user/jim_doe", "jim_doe", "").Code)
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	send := func(method string, body string, header string, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/api/v1/user/john_doe", strings.NewReader(body))
+		if method == "POST" {
+			req.URL.Path = "/api/v1/user"
+		}
+		req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	send("POST", `{"name": "John Doe", "email": "test@example.com", "age": 24}`, "", "")
+	w := send("GET", "", "", "")
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, http.StatusNotModified, send("GET", "", "If-None-Match", etag).Code)
+	assert.Equal(t, http.StatusNotModified, send("GET", "", "If-None-Match", "W/"+etag).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "", "If-None-Match", `"other"`).Code)
+	// If-Match uses the strong comparison, which a weak tag never passes
+	assert.Equal(t, http.StatusPreconditionFailed, send("PUT", `{"name": "John Smith", "email": "test@example.com", "age": 24}`, "If-Match", "W/"+etag).Code)
+
+	w = send("PUT", `{"name": "John Smith", "email": "test@example.com", "age": 24}`, "If-Match", etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	newETag := w.Header().Get("ETag")
+	assert.NotEqual(t, etag, newETag)
+	assert.Equal(t, newETag, send("GET", "", "", "").Header().Get("ETag"))
+
+	// a client still holding the old version does not overwrite the change
+	assert.Equal(t, http.StatusPreconditionFailed, send("PUT", `{"name": "John Doe", "email": "test@example.com", "age": 24}`, "If-Match", etag).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, send("DELETE", "", "If-Match", etag).Code)
+	assert.Equal(t, "John Smith", s.Users.get("john_doe").Name)
+
+	// a write that lost the race in the database is rejected too
+	stale := s.Users.get("john_doe")
+	assert.Nil(t, s.DB.Update(stale))
+	assert.ErrorIs(t, s.DB.Update(stale), spec.ErrVersionConflict)
+	_, err := softDelete(s.DB, stale, "")
+	assert.ErrorIs(t, err, spec.ErrVersionConflict)
+	assert.Equal(t, http.StatusPreconditionFailed, send("DELETE", "", "", "").Code)
+	_, err = s.DB.Read("john_doe")
+	assert.Nil(t, err, "stale delete went through")
+}
+
+func TestPatchUser(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	send := func(method string, contentType string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/api/v1/user/john_doe", strings.NewReader(body))
+		if method == "POST" {
+			req.URL.Path = "/api/v1/user"
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	send("POST", "application/json", `{"name": "John Doe", "email": "test@example.com", "age": 24}`)
+	var user UserResponse
+
+	// a merge patch only changes the members it has, and null clears one
+	w := send("PATCH", mergePatchType, `{"name": "John Smith", "age": null}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &user)
+	assert.Equal(t, UserResponse{Name: "John Smith", Email: "test@example.com", Age: 0}, user)
+	assert.Equal(t, uint(0), s.Users.get("john_doe").Age)
+	stored, _ := s.DB.Read("john_doe")
+	assert.Equal(t, uint(0), stored.Age, "zero age not written")
+
+	w = send("PATCH", jsonPatchType, `[
+		{"op": "test", "path": "/name", "value": "John Smith"},
+		{"op": "replace", "path": "/age", "value": 30},
+		{"op": "copy", "from": "/name", "path": "/name"}
+	]`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &user)
+	assert.Equal(t, uint(30), user.Age)
+
+	// a failed test leaves the user untouched
+	w = send("PATCH", jsonPatchType, `[
+		{"op": "replace", "path": "/age", "value": 40},
+		{"op": "test", "path": "/name", "value": "John Doe"}
+	]`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, uint(30), s.Users.get("john_doe").Age)
+
+	assert.Equal(t, http.StatusBadRequest, send("PATCH", mergePatchType, `{"admin": true}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send("PATCH", mergePatchType, `{"email": "nope"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send("PATCH", jsonPatchType, `[{"op": "remove", "path": "/name"}]`).Code)
+	assert.Equal(t, http.StatusBadRequest, send("PATCH", jsonPatchType, `[{"op": "replace", "path": "/age", "value": "old"}]`).Code)
+	w = send("PATCH", "application/json", `{"age": 1}`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Contains(t, w.Header().Get("Accept-Patch"), mergePatchType)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	send := func(key string, password string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(body))
+		req.SetBasicAuth("john_doe", password)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	body := `{"name": "John Doe", "email": "test@example.com", "age": 24}`
+	w := send("first", "Tr0ub4dor&3", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := w.Body.String()
+
+	// a retry gets the original response instead of a conflict
+	w = send("first", "Tr0ub4dor&3", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, created, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, http.StatusBadRequest, send("", "Tr0ub4dor&3", body).Code)
+	assert.Equal(t, http.StatusBadRequest, send("second", "Tr0ub4dor&3", body).Code)
+
+	// the key cannot be reused for another request
+	assert.Equal(t, http.StatusUnprocessableEntity, send("first", "Tr0ub4dor&3", `{"name": "Jane Doe", "email": "test@example.com"}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, send("first", "another-Secret-9", body).Code)
+	assert.Equal(t, http.StatusBadRequest, send(strings.Repeat("k", 256), "Tr0ub4dor&3", body).Code)
+
+	// the response is stored in the database, so a replica with the same
+	// signing key replays it too
+	replica := newServerContext(s.DB, loadConfig())
+	replica.IdempotencySecret = idempotencySecret(s.SigningKey)
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(body))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	req.Header.Set("Idempotency-Key", "first")
+	newRouter(replica).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, created, w.Body.String())
+
+	// the response is forgotten once it expires
+	s.Config.IdempotencyTTL = time.Millisecond
+	send("third", "first-Secret-1", body)
+	time.Sleep(5 * time.Millisecond)
+	w = send("third", "first-Secret-1", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+}
+
+func TestBatch(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	send := func(username string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/batch", strings.NewReader(body))
+		req.SetBasicAuth(username, "Tr0ub4dor&3")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	batch := func(body string) []BatchResult {
+		w := send("john_doe", body)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response BatchResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Results
+	}
+	statuses := func(results []BatchResult) []int {
+		var codes []int
+		for _, result := range results {
+			codes = append(codes, result.Status)
+		}
+		return codes
+	}
+	jsonUser, _ := json.Marshal(UserResponse{Name: "Someone", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, send("john_doe", `{"operations": [{"op": "delete", "username": "john_doe"}]}`).Code)
+	admin := s.Users.get("john_doe")
+	admin.Admin = true
+	s.DB.Update(admin)
+	admin.Version++
+	s.Users.put(admin)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("imported-Secret-5"), bcrypt.MinCost)
+	results := batch(`{"operations": [
+		{"op": "create", "username": "jane_doe", "password": "first-Secret-1", "user": {"name": "Jane Doe", "email": "jane@example.com", "age": 30}},
+		{"op": "create", "username": "jim_doe", "password_hash": "` + string(hash) + `", "user": {"name": "Jim Doe", "email": "jim@example.com"}},
+		{"op": "create", "username": "jane_doe", "password": "first-Secret-1", "user": {"name": "Jane Doe", "email": "jane@example.com"}},
+		{"op": "create", "username": "weak", "password": "password", "user": {"name": "Weak", "email": "weak@example.com"}},
+		{"op": "create", "username": "no_password", "user": {"name": "No Password", "email": "none@example.com"}},
+		{"op": "create", "username": "bad_hash", "password_hash": "$argon2id$v=19$m=0,t=0,p=0$c29tZXNhbHQ$a2V5a2V5", "user": {"name": "Bad Hash", "email": "bad@example.com"}},
+		{"op": "update", "username": "jane_doe", "user": {"name": "Jane Smith", "email": "jane@example.com", "age": 0}},
+		{"op": "delete", "username": "nobody"},
+		{"op": "rename", "username": "jane_doe"}
+	]}`)
+	assert.Equal(t, []int{http.StatusCreated, http.StatusCreated, http.StatusConflict, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK, http.StatusNotFound, http.StatusBadRequest}, statuses(results))
+	assert.Equal(t, "jim_doe", results[1].Username)
+	assert.Equal(t, spec.StatusActive, s.Users.get("jim_doe").Status)
+	assert.Empty(t, s.Users.get("no_password").Username)
+	assert.Empty(t, s.Users.get("bad_hash").Username)
+	assert.Equal(t, "Jane Smith", s.Users.get("jane_doe").Name)
+	assert.Equal(t, uint(0), s.Users.get("jane_doe").Age)
+	_, found := s.Users.lookup("weak")
+	assert.False(t, found)
+
+	// imported hashes and hashed passwords both log in
+	for username, password := range map[string]string{"jane_doe": "first-Secret-1", "jim_doe": "imported-Secret-5"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/api/v1/user/"+username, nil)
+		req.SetBasicAuth(username, password)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, username)
+	}
+
+	// an atomic batch is rolled back if any operation fails
+	results = batch(`{"atomic": true, "operations": [
+		{"op": "delete", "username": "jim_doe"},
+		{"op": "create", "username": "jill_doe", "password_hash": "` + string(hash) + `", "user": {"name": "Jill Doe", "email": "jill@example.com"}},
+		{"op": "update", "username": "nobody", "user": {"name": "Nobody", "email": "nobody@example.com"}},
+		{"op": "delete", "username": "jane_doe"}
+	]}`)
+	assert.Equal(t, []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound, http.StatusFailedDependency}, statuses(results))
+	for _, username := range []string{"jim_doe", "jane_doe"} {
+		_, err := s.DB.Read(username)
+		assert.Nil(t, err, username)
+		assert.Equal(t, username, s.Users.get(username).Username)
+	}
+	_, err := s.DB.Read("jill_doe")
+	assert.NotNil(t, err)
+
+	results = batch(`{"atomic": true, "operations": [
+		{"op": "delete", "username": "jim_doe"},
+		{"op": "create", "username": "jill_doe", "password_hash": "` + string(hash) + `", "user": {"name": "Jill Doe", "email": "jill@example.com"}}
+	]}`)
+	assert.Equal(t, []int{http.StatusOK, http.StatusCreated}, statuses(results))
+	assert.Empty(t, s.Users.get("jim_doe").Username)
+	assert.Equal(t, "jill_doe", s.Users.get("jill_doe").Username)
+	entries, _ := s.DB.ReadAudit(spec.AuditQuery{Target: "jim_doe"})
+	if assert.NotEmpty(t, entries) {
+		assert.Equal(t, auditUserDelete, entries[0].Action)
+		assert.Equal(t, "john_doe", entries[0].Actor)
+	}
+
+	// created users get the signup status
+	s.Config.SignupStatus = spec.StatusPending
+	results = batch(`{"operations": [{"op": "create", "username": "joe_doe", "password": "first-Secret-1", "user": {"name": "Joe Doe", "email": "joe@example.com"}}]}`)
+	assert.Equal(t, []int{http.StatusCreated}, statuses(results))
+	assert.Equal(t, spec.StatusPending, s.Users.get("joe_doe").Status)
+
+	assert.Equal(t, http.StatusBadRequest, send("john_doe", `{"operations": []}`).Code)
+}
+
+func TestAdminTargeting(t *testing.T) {
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	router := newRouter(s)
+	send := func(method string, path string, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	jsonUser, _ := json.Marshal(UserResponse{Name: "Someone", Email: "test@example.com", Age: 24})
+	send("POST", "/api/v1/user", string(jsonUser))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("jane_smith", "first-Secret-1")
+	router.ServeHTTP(w, req)
+	admin := s.Users.get("john_doe")
+	admin.Admin = true
+	s.DB.Update(admin)
+	admin.Version++
+	s.Users.put(admin)
+
+	assert.Equal(t, http.StatusOK, send("GET", "/api/v1/user/jane_smith", ""))
+	assert.Equal(t, http.StatusCreated, send("POST", "/api/v1/user/jane_smith/apikeys", `{"name": "support", "scopes": ["users:read"]}`))
+	// an admin cannot act as the user or take over their credentials
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/v1/user/jane_smith/session", ""))
+	assert.Equal(t, http.StatusBadRequest, send("PUT", "/api/v1/user/jane_smith/password", `{"password": "correct horse battery"}`))
+	assert.Equal(t, http.StatusBadRequest, send("DELETE", "/api/v1/user/jane_smith/totp", ""))
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/v1/user/jane_smith/passkey/register/begin", ""))
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/v1/user/jane_smith/export", ""))
+	assert.Equal(t, http.StatusBadRequest, send("GET", "/api/v1/user/jane_smith/logins", ""))
+}
+
+func TestUserCacheConcurrentAccess(t *testing.T) {
+	cache := newUserCache()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				username := "user" + strconv.Itoa(j%10)
+				cache.put(spec.User{Username: username})
+				cache.update(username, func(user *spec.User) { user.TOTPLastStep++ })
+				cache.get(username)
+				cache.len()
+				if j%3 == 0 {
+					cache.delete(username)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, cache.len(), 10)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+type SessionResponse struct {
+	Username  string    `json:"username"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(c *gin.Context) (string, bool) {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return token, found && token != ""
+}
+
+// issueSession stores a new session for username and returns the token the
+// client sends back as "Authorization: Bearer <token>". Password and passkey
+// logins both end here so they produce the same kind of token.
+func issueSession(ctx context.Context, s *ServerContext, username string, method string) (SessionResponse, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return SessionResponse{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	session := spec.Session{
+		TokenHash: hashToken(token),
+		Username:  username,
+		Method:    method,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.Config.SessionTTL),
+	}
+	err := s.db(ctx).CreateSession(session)
+	if err != nil {
+		return SessionResponse{}, err
+	}
+	return SessionResponse{Username: username, Token: token, ExpiresAt: session.ExpiresAt}, nil
+}
+
+// authenticateSession authenticates a request carrying a bearer token instead
+// of Basic Auth. The second factor was already checked when the session was issued.
+func authenticateSession(c *gin.Context, s *ServerContext, token string) (user spec.User, ok bool) {
+	defer func() { s.Metrics.authAttempt("session", ok) }()
+	session, err := s.db(c).ReadSession(hashToken(token))
+	if err != nil || time.Now().After(session.ExpiresAt) {
+		abortUnauthorized(c)
+		return spec.User{}, false
+	}
+	user, found := s.Users.lookup(session.Username)
+	if !found {
+		abortUnauthorized(c)
+		return spec.User{}, false
+	}
+	if !checkStatus(c, user) {
+		return spec.User{}, false
+	}
+	return user, true
+}
+
+// createSession exchanges the password (and second factor) checked by runAuth
+// for a session token.
+func createSession(c *gin.Context, s *ServerContext) {
+	if _, isBearer := bearerToken(c); isBearer {
+		c.AbortWithError(http.StatusBadRequest, errors.New("log in with a password or passkey"))
+		return
+	}
+	// runAuth recorded the login
+	response, err := issueSession(c, s, c.Param("username"), "password")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, response)
+}
+
+// deleteSession revokes the bearer token the request was made with.
+func deleteSession(c *gin.Context, s *ServerContext) {
+	token, isBearer := bearerToken(c)
+	if !isBearer {
+		c.AbortWithError(http.StatusBadRequest, errors.New("request was not made with a session token"))
+		return
+	}
+	err := s.db(c).DeleteSession(hashToken(token))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
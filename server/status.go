@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// statusTransitions lists the statuses each status can be changed to. Deleted
+// users can only be restored by making them active.
+var statusTransitions = map[string][]string{
+	spec.StatusPending:   {spec.StatusActive, spec.StatusDeleted},
+	spec.StatusActive:    {spec.StatusSuspended, spec.StatusLocked, spec.StatusDeleted},
+	spec.StatusSuspended: {spec.StatusActive, spec.StatusDeleted},
+	spec.StatusLocked:    {spec.StatusActive, spec.StatusDeleted},
+	spec.StatusDeleted:   {spec.StatusActive},
+}
+
+type StatusResponse struct {
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+type StatusChange struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+func canTransition(from string, to string) bool {
+	return slices.Contains(statusTransitions[from], to)
+}
+
+// withStatus returns user with its status changed now for reason.
+func withStatus(user spec.User, status string, reason string) spec.User {
+	user.Status = status
+	user.StatusReason = reason
+	user.StatusChangedAt = time.Now()
+	return user
+}
+
+// checkStatus rejects users whose account is not active. It is only checked
+// once the user has proven who they are, so the status is not revealed to
+// anyone else.
+func checkStatus(c *gin.Context, user spec.User) bool {
+	if user.Status == spec.StatusActive {
+		return true
+	}
+	c.AbortWithError(http.StatusForbidden, errors.New("account is "+user.Status))
+	return false
+}
+
+// anyUser returns the live or deleted user with the given username.
+func anyUser(c *gin.Context, s *ServerContext, username string) (spec.User, bool) {
+	if user, found := s.Users.lookup(username); found {
+		return user, true
+	}
+	user, err := s.db(c).ReadDeleted(username)
+	return user, err == nil
+}
+
+func getStatus(c *gin.Context, s *ServerContext) {
+	user, found := anyUser(c, s, c.Param("username"))
+	if !found {
+		c.AbortWithError(http.StatusNotFound, errors.New("username not found"))
+		return
+	}
+	c.IndentedJSON(http.StatusOK, StatusResponse{Status: user.Status, Reason: user.StatusReason, ChangedAt: user.StatusChangedAt})
+}
+
+// changeStatus moves a user to another status. Suspending or locking a user
+// needs a reason; deleting and restoring work as the DELETE and restore routes.
+func changeStatus(c *gin.Context, s *ServerContext) {
+	var body StatusChange
+	err := c.BindJSON(&body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	user, found := anyUser(c, s, c.Param("username"))
+	if !found {
+		c.AbortWithError(http.StatusNotFound, errors.New("username not found"))
+		return
+	}
+	if !canTransition(user.Status, body.Status) {
+		c.AbortWithError(http.StatusConflict, errors.New("cannot change status from "+user.Status+" to "+body.Status))
+		return
+	}
+	if (body.Status == spec.StatusSuspended || body.Status == spec.StatusLocked) && body.Reason == "" {
+		c.AbortWithError(http.StatusBadRequest, errors.New("a reason is required"))
+		return
+	}
+	switch {
+	case body.Status == spec.StatusDeleted:
+		err = deleteAccount(c, s, user, body.Reason)
+		user = withStatus(user, body.Status, body.Reason)
+	case user.Status == spec.StatusDeleted:
+		user, err = restoreAccount(c, s, user, body.Status, body.Reason)
+	default:
+		before := user
+		user = withStatus(user, body.Status, body.Reason)
+		err = s.db(c).UpdateStatus(user)
+		if err == nil {
+			user.Version++
+			s.Users.put(user)
+			recordAudit(c, s, auditStatusChange, user.Username, userChanges(before, user))
+		}
+	}
+	if errors.Is(err, errRestoreWindowPassed) {
+		c.AbortWithError(http.StatusGone, err)
+		return
+	}
+	if errors.Is(err, spec.ErrVersionConflict) {
+		c.AbortWithError(http.StatusConflict, errors.New("user has been changed, try again"))
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, StatusResponse{Status: user.Status, Reason: user.StatusReason, ChangedAt: user.StatusChangedAt})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type expiringValue[T any] struct {
+	value   T
+	expires time.Time
+}
+
+// expiringStore keeps short-lived state such as unfinished WebAuthn ceremonies,
+// OAuth authorization codes and data exports in memory.
+type expiringStore[T any] struct {
+	mu        sync.Mutex
+	values    map[string]expiringValue[T]
+	lastSweep time.Time
+}
+
+func newExpiringStore[T any]() *expiringStore[T] {
+	return &expiringStore[T]{values: make(map[string]expiringValue[T])}
+}
+
+func (es *expiringStore[T]) put(key string, value T, ttl time.Duration) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	now := time.Now()
+	es.sweep(now)
+	es.values[key] = expiringValue[T]{value: value, expires: now.Add(ttl)}
+}
+
+// add stores value under key unless the key holds a value that has not
+// expired, in which case it returns that value and false.
+func (es *expiringStore[T]) add(key string, value T, ttl time.Duration) (T, bool) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	now := time.Now()
+	if v, found := es.values[key]; found && !now.After(v.expires) {
+		return v.value, false
+	}
+	es.sweep(now)
+	es.values[key] = expiringValue[T]{value: value, expires: now.Add(ttl)}
+	return value, true
+}
+
+// sweep drops expired values. It runs at most once a minute; until then get
+// and take ignore expired values.
+func (es *expiringStore[T]) sweep(now time.Time) {
+	if now.Sub(es.lastSweep) < time.Minute {
+		return
+	}
+	es.lastSweep = now
+	for k, v := range es.values {
+		if now.After(v.expires) {
+			delete(es.values, k)
+		}
+	}
+}
+
+// get returns the value stored under key, leaving it in the store.
+func (es *expiringStore[T]) get(key string) (T, bool) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	v, found := es.values[key]
+	if !found || time.Now().After(v.expires) {
+		var zero T
+		return zero, false
+	}
+	return v.value, true
+}
+
+// take removes and returns the value stored under key, so each value can only
+// be used once.
+func (es *expiringStore[T]) take(key string) (T, bool) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	v, found := es.values[key]
+	delete(es.values, key)
+	if !found || time.Now().After(v.expires) {
+		var zero T
+		return zero, false
+	}
+	return v.value, true
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// ClientIdentity is what a client certificate may do: act as the service
+// account Username with the Scopes of an API key.
+type ClientIdentity struct {
+	Username string   `json:"username"`
+	Scopes   []string `json:"scopes"`
+}
+
+// certReloader serves the key pair in CertFile and KeyFile and loads it again
+// when either file changes, checking at most once per Interval.
+type certReloader struct {
+	CertFile string
+	KeyFile  string
+	Interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{CertFile: certFile, KeyFile: keyFile, Interval: interval}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	r.cert, r.modTime, r.checked = &cert, modTime, time.Now()
+	return r, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the new files cannot
+// be loaded, for example because only one has been replaced yet, the old
+// certificate is kept and loading is tried again after the next interval.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < r.Interval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	modTime, err := r.latestModTime()
+	if err != nil || !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		slog.Error("reloading TLS certificate", "error", err)
+		return r.cert, nil
+	}
+	r.cert, r.modTime = &cert, modTime
+	slog.Info("reloaded TLS certificate", "file", r.CertFile)
+	return r.cert, nil
+}
+
+// newTLSConfig builds the server's TLS configuration, or returns nil if TLS
+// is not configured.
+func newTLSConfig(config Config) (*tls.Config, error) {
+	if config.TLSCertFile == "" && config.TLSKeyFile == "" {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile, config.TLSReloadInterval)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if config.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client CA: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + config.TLSClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.TLSRequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+// hsts tells browsers to use only HTTPS for this host from now on. It only
+// answers requests that arrived over TLS, as the header is ignored otherwise.
+func hsts(config Config) gin.HandlerFunc {
+	value := "max-age=" + strconv.Itoa(int(config.HSTSMaxAge.Seconds()))
+	if config.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return func(c *gin.Context) {
+		if c.Request.TLS != nil && config.HSTSMaxAge > 0 {
+			c.Header("Strict-Transport-Security", value)
+		}
+		c.Next()
+	}
+}
+
+// clientIdentity returns the identity mapped to the verified client
+// certificate of the request, matched by common name, DNS name or URI. The
+// certificate comes with the connection whatever the request, so explicit
+// credentials in an Authorization header take precedence over it.
+func clientIdentity(c *gin.Context, s *ServerContext) (string, ClientIdentity, bool) {
+	if c.GetHeader("Authorization") != "" || c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return "", ClientIdentity{}, false
+	}
+	cert := c.Request.TLS.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		if identity, found := s.Config.ClientIdentities[name]; found {
+			return name, identity, true
+		}
+	}
+	return "", ClientIdentity{}, false
+}
+
+// authenticateClientCert resolves the service account of a client identity and
+// checks it was granted scope.
+func authenticateClientCert(c *gin.Context, s *ServerContext, name string, identity ClientIdentity, scope string) (owner spec.User, ok bool) {
+	defer func() { s.Metrics.authAttempt("mtls", ok) }()
+	owner, found := s.Users.lookup(identity.Username)
+	if !found {
+		c.AbortWithError(http.StatusForbidden, errors.New("no service account for client certificate "+name))
+		return spec.User{}, false
+	}
+	if !checkStatus(c, owner) {
+		return spec.User{}, false
+	}
+	if !slices.Contains(identity.Scopes, scope) {
+		c.AbortWithError(http.StatusForbidden, errors.New("client certificate lacks scope "+scope))
+		return spec.User{}, false
+	}
+	return owner, true
+}
+
+func runClientCertAuth(c *gin.Context, s *ServerContext, name string, identity ClientIdentity, scope string) {
+	owner, ok := authenticateClientCert(c, s, name, identity, scope)
+	if !ok {
+		return
+	}
+	asAdmin := owner.Admin && slices.Contains(identity.Scopes, scopeAdmin)
+	if !authorizeTarget(c, s, owner, asAdmin) {
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jameshw-dev01/user-api/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// issueCert creates a certificate for name signed by parent, or self-signed
+// if parent is nil.
+func issueCert(t *testing.T, name string, serial int64, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeCert(t *testing.T, cert tls.Certificate, certFile string, keyFile string) {
+	key, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, issueCert(t, "localhost", 1, nil), certFile, keyFile)
+	reloader, err := newCertReloader(certFile, keyFile, 0)
+	assert.Nil(t, err)
+	cert, _ := reloader.GetCertificate(nil)
+	assert.Equal(t, int64(1), cert.Leaf.SerialNumber.Int64())
+
+	writeCert(t, issueCert(t, "localhost", 2, nil), certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	cert, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, int64(2), cert.Leaf.SerialNumber.Int64())
+
+	// a broken file keeps the last good certificate
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	cert, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, int64(2), cert.Leaf.SerialNumber.Int64())
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, "Test CA", 1, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, issueCert(t, "localhost", 2, &ca), certFile, keyFile)
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_CLIENT_CA_FILE", caFile)
+	t.Setenv("TLS_CLIENT_IDENTITIES", `{"billing.internal": {"username": "svc_billing", "scopes": ["users:read"]}}`)
+
+	s := newServerContext(database.GetDBConnection(true, "PROD"), loadConfig())
+	jsonUser, _ := json.Marshal(UserResponse{Name: "Billing", Email: "billing@example.com"})
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := newHTTPServer(s.Config, newRouter(s))
+	var err error
+	server.TLSConfig, err = newTLSConfig(s.Config)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go run(ctx, s, server, serve(server, listener))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{issueCert(t, "billing.internal", 3, &ca)},
+	}}}
+	url := "https://" + listener.Addr().String() + "/api/v1/user"
+	req, _ := http.NewRequest("POST", url, strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("svc_billing", "Tr0ub4dor&3")
+	res, err := client.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "max-age=31536000", res.Header.Get("Strict-Transport-Security"))
+
+	// the certificate alone authenticates the service for its scopes
+	res, _ = client.Get(url + "/svc_billing")
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	req, _ = http.NewRequest("DELETE", url+"/svc_billing", nil)
+	res, _ = client.Do(req)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// explicit credentials are checked instead of the certificate
+	req, _ = http.NewRequest("GET", url+"/svc_billing", nil)
+	req.SetBasicAuth("svc_billing", "wrong-Password-1")
+	res, _ = client.Do(req)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// clients without a certificate still use passwords
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	res, _ = anonymous.Get(url + "/svc_billing")
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+const (
+	totpIssuer = "user-api"
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many periods either side of now a code is accepted for
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpURI is the otpauth:// provisioning URI authenticator apps read from a QR code.
+func totpURI(username string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// hotp computes the RFC 4226 code of key for counter.
+func hotp(key []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// verifyTOTP checks code against the RFC 6238 codes of secret around now and
+// returns the time step of the code that matched.
+func verifyTOTP(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	step := now.Unix() / totpPeriod
+	matched := int64(0)
+	valid := false
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected := hotp(key, uint64(step+int64(i)))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			matched = step + int64(i)
+			valid = true
+		}
+	}
+	return matched, valid
+}
+
+// useTOTP checks code for user and accepts it only once: a code of a time step
+// at or before the last accepted one is rejected, so an intercepted code
+// cannot be replayed.
+func useTOTP(ctx context.Context, s *ServerContext, user spec.User, code string) (bool, error) {
+	step, valid := verifyTOTP(user.TOTPSecret, code, time.Now())
+	if !valid || step <= user.TOTPLastStep {
+		return false, nil
+	}
+	fresh, err := s.db(ctx).UseTOTPStep(user.Username, step)
+	if err != nil || !fresh {
+		return false, err
+	}
+	s.Users.update(user.Username, func(cached *spec.User) { cached.TOTPLastStep = step })
+	return true, nil
+}
+
+// newRecoveryCodes returns plain codes to show the user once and the hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(raw)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalises and hashes a recovery code. The codes are random
+// enough that a fast hash is sufficient, and it lets the database look them up.
+func hashRecoveryCode(code string) string {
+	normalised := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalised))
+	return hex.EncodeToString(sum[:])
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPCode struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// checkSecondFactor enforces TOTP for users who enabled it, accepting either a
+// current code not used before in X-TOTP-Code or an unused code in
+// X-Recovery-Code.
+func checkSecondFactor(c *gin.Context, s *ServerContext, user spec.User) bool {
+	if !user.TOTPEnabled {
+		return true
+	}
+	if code := c.GetHeader("X-TOTP-Code"); code != "" {
+		used, err := useTOTP(c, s, user, code)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+		if used {
+			return true
+		}
+	} else if code := c.GetHeader("X-Recovery-Code"); code != "" {
+		used, err := s.db(c).ConsumeRecoveryCode(user.Username, hashRecoveryCode(code))
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+		if used {
+			return true
+		}
+	}
+	c.Header("X-Second-Factor", "totp")
+	c.AbortWithError(http.StatusUnauthorized, errors.New("second factor required"))
+	return false
+}
+
+// enrollTOTP starts enrollment with a new secret. The factor is not enforced
+// until the user proves they can generate codes with confirmTOTP.
+func enrollTOTP(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	user := s.Users.get(username)
+	if user.TOTPEnabled {
+		c.AbortWithError(http.StatusBadRequest, errors.New("totp already enabled"))
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	user.TOTPSecret = secret
+	err = s.db(c).UpdateTOTP(user)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.Users.put(user)
+	recordAudit(c, s, auditTOTPEnroll, username, nil)
+	c.IndentedJSON(http.StatusCreated, TOTPEnrollment{Secret: secret, URI: totpURI(username, secret)})
+}
+
+func confirmTOTP(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	user := s.Users.get(username)
+	var body TOTPCode
+	err := c.BindJSON(&body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		c.AbortWithError(http.StatusBadRequest, errors.New("no totp enrollment in progress"))
+		return
+	}
+	used, err := useTOTP(c, s, user, body.Code)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !used {
+		c.AbortWithError(http.StatusBadRequest, errors.New("invalid totp code"))
+		return
+	}
+	user = s.Users.get(username)
+	codes, err := replaceRecoveryCodes(c, s, username)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	user.TOTPEnabled = true
+	err = s.db(c).UpdateTOTP(user)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.Users.put(user)
+	recordAudit(c, s, auditTOTPConfirm, username, []spec.FieldChange{{Field: "totp_enabled", Before: false, After: true}})
+	c.IndentedJSON(http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+}
+
+func regenerateRecoveryCodes(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	if !s.Users.get(username).TOTPEnabled {
+		c.AbortWithError(http.StatusBadRequest, errors.New("totp not enabled"))
+		return
+	}
+	if !reauthenticateBody(c, s, s.Users.get(username)) {
+		return
+	}
+	codes, err := replaceRecoveryCodes(c, s, username)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	recordAudit(c, s, auditRecoveryCodes, username, nil)
+	c.IndentedJSON(http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+}
+
+func disableTOTP(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	user := s.Users.get(username)
+	if !reauthenticateBody(c, s, user) {
+		return
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	err := s.db(c).UpdateTOTP(user)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	err = s.db(c).ReplaceRecoveryCodes(username, nil)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	before := s.Users.get(username)
+	s.Users.put(user)
+	recordAudit(c, s, auditTOTPDisable, username, userChanges(before, user))
+	c.Status(http.StatusNoContent)
+}
+
+func replaceRecoveryCodes(ctx context.Context, s *ServerContext, username string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return codes, s.db(ctx).ReplaceRecoveryCodes(username, hashes)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// userCache is the in-memory copy of the users table. Requests read and write
+// it concurrently, so every access holds its lock.
+type userCache struct {
+	mu    sync.RWMutex
+	users map[string]spec.User
+	// hits and misses count the lookups, for the cache metrics
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newUserCache() *userCache {
+	return &userCache{users: make(map[string]spec.User)}
+}
+
+// lookup returns the cached user with the given username.
+func (uc *userCache) lookup(username string) (spec.User, bool) {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	user, found := uc.users[username]
+	if found {
+		uc.hits.Add(1)
+	} else {
+		uc.misses.Add(1)
+	}
+	return user, found
+}
+
+// get returns the cached user with the given username, or the zero User.
+func (uc *userCache) get(username string) spec.User {
+	user, _ := uc.lookup(username)
+	return user
+}
+
+func (uc *userCache) put(user spec.User) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.users[user.Username] = user
+}
+
+// update changes the cached user with the given username in place, if there
+// is one, so concurrent changes to other fields are not lost.
+func (uc *userCache) update(username string, change func(user *spec.User)) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if user, found := uc.users[username]; found {
+		change(&user)
+		uc.users[username] = user
+	}
+}
+
+func (uc *userCache) delete(username string) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	delete(uc.users, username)
+}
+
+func (uc *userCache) len() int {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	return len(uc.users)
+}
+
+// all returns a copy of every cached user, in no particular order.
+func (uc *userCache) all() []spec.User {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	users := make([]spec.User, 0, len(uc.users))
+	for _, user := range uc.users {
+		users = append(users, user)
+	}
+	return users
+}
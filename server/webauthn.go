@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/jameshw-dev01/user-api/spec"
+)
+
+// ceremonyTimeout bounds how long a client has between beginning and finishing
+// a registration or login ceremony.
+const ceremonyTimeout = 5 * time.Minute
+
+// webauthnUser adapts a spec.User and its credentials to webauthn.User. The
+// username is used as the user handle, so it is what a passkey identifies.
+type webauthnUser struct {
+	user        spec.User
+	credentials []spec.Credential
+}
+
+func (u webauthnUser) WebAuthnID() []byte {
+	return []byte(u.user.Username)
+}
+
+func (u webauthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u webauthnUser) WebAuthnDisplayName() string {
+	return u.user.Name
+}
+
+func (u webauthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	var credentials []webauthn.Credential
+	for _, c := range u.credentials {
+		credentials = append(credentials, toWebAuthnCredential(c))
+	}
+	return credentials
+}
+
+func toWebAuthnCredential(c spec.Credential) webauthn.Credential {
+	var transports []protocol.AuthenticatorTransport
+	for _, t := range c.Transports {
+		transports = append(transports, protocol.AuthenticatorTransport(t))
+	}
+	return webauthn.Credential{
+		ID:              c.ID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transport:       transports,
+		Flags: webauthn.CredentialFlags{
+			UserPresent:    c.UserPresent,
+			UserVerified:   c.UserVerified,
+			BackupEligible: c.BackupEligible,
+			BackupState:    c.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{AAGUID: c.AAGUID, SignCount: c.SignCount},
+	}
+}
+
+func toSpecCredential(username string, c webauthn.Credential) spec.Credential {
+	var transports []string
+	for _, t := range c.Transport {
+		transports = append(transports, string(t))
+	}
+	return spec.Credential{
+		ID:              c.ID,
+		Username:        username,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transports:      transports,
+		AAGUID:          c.Authenticator.AAGUID,
+		SignCount:       c.Authenticator.SignCount,
+		UserPresent:     c.Flags.UserPresent,
+		UserVerified:    c.Flags.UserVerified,
+		BackupEligible:  c.Flags.BackupEligible,
+		BackupState:     c.Flags.BackupState,
+		CreatedAt:       time.Now(),
+	}
+}
+
+func loadWebAuthnUser(ctx context.Context, s *ServerContext, username string) (webauthnUser, error) {
+	user, found := s.Users.lookup(username)
+	if !found {
+		return webauthnUser{}, errors.New("username not found")
+	}
+	credentials, err := s.db(ctx).ReadCredentials(username)
+	if err != nil {
+		return webauthnUser{}, err
+	}
+	return webauthnUser{user: user, credentials: credentials}, nil
+}
+
+// beginPasskeyRegistration starts registering a passkey. Adding a credential
+// needs reauthentication, like changing the password; finishing needs the
+// ceremony started here.
+func beginPasskeyRegistration(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	if !reauthenticateBody(c, s, s.Users.get(username)) {
+		return
+	}
+	user, err := loadWebAuthnUser(c, s, username)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	options, session, err := s.WebAuthn.BeginRegistration(
+		user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.Ceremonies.put("register:"+username, *session, ceremonyTimeout)
+	c.IndentedJSON(http.StatusOK, options)
+}
+
+func finishPasskeyRegistration(c *gin.Context, s *ServerContext) {
+	username := c.Param("username")
+	session, found := s.Ceremonies.take("register:" + username)
+	if !found {
+		c.AbortWithError(http.StatusBadRequest, errors.New("no passkey registration in progress"))
+		return
+	}
+	user, err := loadWebAuthnUser(c, s, username)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	credential, err := s.WebAuthn.FinishRegistration(user, session, c.Request)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	err = s.db(c).CreateCredential(toSpecCredential(username, *credential))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	recordAudit(c, s, auditPasskeyRegister, username, []spec.FieldChange{
+		{Field: "passkey", After: base64.RawURLEncoding.EncodeToString(credential.ID)},
+	})
+	c.Status(http.StatusCreated)
+}
+
+// beginPasskeyLogin starts a discoverable login, so the client does not say
+// which user it is until the authenticator has signed the challenge. The
+// ceremony ID returned in X-WebAuthn-Ceremony must be sent back to finish.
+func beginPasskeyLogin(c *gin.Context, s *ServerContext) {
+	options, session, err := s.WebAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+	s.Ceremonies.put("login:"+id, *session, ceremonyTimeout)
+	c.Header("X-WebAuthn-Ceremony", id)
+	c.IndentedJSON(http.StatusOK, options)
+}
+
+func finishPasskeyLogin(c *gin.Context, s *ServerContext) {
+	session, found := s.Ceremonies.take("login:" + c.GetHeader("X-WebAuthn-Ceremony"))
+	if !found {
+		c.AbortWithError(http.StatusBadRequest, errors.New("no passkey login in progress"))
+		return
+	}
+	var user webauthnUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		var err error
+		user, err = loadWebAuthnUser(c, s, string(userHandle))
+		return user, err
+	}
+	credential, err := s.WebAuthn.FinishDiscoverableLogin(handler, session, c.Request)
+	s.Metrics.authAttempt("passkey", err == nil && !credential.Authenticator.CloneWarning)
+	if err != nil {
+		if user.user.Username != "" {
+			recordLogin(c, s, user.user.Username, "passkey", loginInvalidCredentials)
+		}
+		abortUnauthorized(c)
+		return
+	}
+	if credential.Authenticator.CloneWarning {
+		recordLogin(c, s, user.user.Username, "passkey", loginClonedAuthenticator)
+		c.AbortWithError(http.StatusUnauthorized, errors.New("authenticator may be cloned"))
+		return
+	}
+	username := user.user.Username
+	if !checkStatus(c, user.user) {
+		recordLogin(c, s, username, "passkey", loginAccountInactive)
+		return
+	}
+	err = s.db(c).UpdateCredential(toSpecCredential(username, *credential))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	recordLogin(c, s, username, "passkey", loginSuccess)
+	response, err := issueSession(c, s, username, "passkey")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, response)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// softAuthenticator is a minimal software passkey: a P-256 key with "none"
+// attestation, enough to drive the WebAuthn ceremonies in tests.
+type softAuthenticator struct {
+	key     *ecdsa.PrivateKey
+	id      []byte
+	rpID    string
+	origin  string
+	counter uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id, rpID: "localhost", origin: "http://localhost:8080"}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+}
+
+func cborInt(v int) []byte {
+	if v < 0 {
+		return cborHead(1, uint64(-1-v))
+	}
+	return cborHead(0, uint64(v))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, uint64(len(s))), s...)
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	a.counter++
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) clientData(kind string, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": kind, "challenge": challenge, "origin": a.origin})
+	return data
+}
+
+func (a *softAuthenticator) create(challenge string) []byte {
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	// COSE_Key {kty: EC2, alg: ES256, crv: P-256, x, y}
+	coseKey := cborHead(5, 5)
+	coseKey = append(coseKey, append(cborInt(1), cborInt(2)...)...)
+	coseKey = append(coseKey, append(cborInt(3), cborInt(-7)...)...)
+	coseKey = append(coseKey, append(cborInt(-1), cborInt(1)...)...)
+	coseKey = append(coseKey, append(cborInt(-2), cborBytes(x)...)...)
+	coseKey = append(coseKey, append(cborInt(-3), cborBytes(y)...)...)
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, coseKey...)
+	// user present, user verified, attested credential data included
+	authData := a.authData(0x45, attested)
+	attestation := cborHead(5, 3)
+	attestation = append(attestation, append(cborText("fmt"), cborText("none")...)...)
+	attestation = append(attestation, append(cborText("attStmt"), cborHead(5, 0)...)...)
+	attestation = append(attestation, append(cborText("authData"), cborBytes(authData)...)...)
+
+	encode := base64.RawURLEncoding.EncodeToString
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    encode(a.id),
+		"rawId": encode(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(a.clientData("webauthn.create", challenge)),
+			"attestationObject": encode(attestation),
+		},
+	})
+	return body
+}
+
+func (a *softAuthenticator) get(challenge string, userHandle string) []byte {
+	authData := a.authData(0x05, nil)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+
+	encode := base64.RawURLEncoding.EncodeToString
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    encode(a.id),
+		"rawId": encode(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData),
+			"authenticatorData": encode(authData),
+			"signature":         encode(signature),
+			"userHandle":        encode([]byte(userHandle)),
+		},
+	})
+	return body
+}
+
+func challengeOf(body []byte) string {
+	var options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	json.Unmarshal(body, &options)
+	return options.PublicKey.Challenge
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	router := setupRouter(true)
+	authenticator := newSoftAuthenticator(t)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/passkey/register/begin", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	credential := authenticator.create(challengeOf(w.Body.Bytes()))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/passkey/register/finish", strings.NewReader(string(credential)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/passkey/login/begin", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	ceremony := w.Header().Get("X-WebAuthn-Ceremony")
+	assertion := authenticator.get(challengeOf(w.Body.Bytes()), "john_doe")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/passkey/login/finish", strings.NewReader(string(assertion)))
+	req.Header.Set("X-WebAuthn-Ceremony", ceremony)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var session SessionResponse
+	json.Unmarshal(w.Body.Bytes(), &session)
+	assert.Equal(t, "john_doe", session.Username)
+
+	// the passkey session token works like a password
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// but it cannot add another passkey without the password
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/passkey/register/begin", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/passkey/register/begin", strings.NewReader(`{"current_password": "Tr0ub4dor&3"}`))
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// a finished ceremony cannot be replayed
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/passkey/login/finish", strings.NewReader(string(assertion)))
+	req.Header.Set("X-WebAuthn-Ceremony", ceremony)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPasswordSession(t *testing.T) {
+	router := setupRouter(true)
+	jsonUser, _ := json.Marshal(UserResponse{Name: "John Doe", Email: "test@example.com", Age: 24})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/user", strings.NewReader(string(jsonUser)))
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/user/john_doe/session", nil)
+	req.SetBasicAuth("john_doe", "Tr0ub4dor&3")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var session SessionResponse
+	json.Unmarshal(w.Body.Bytes(), &session)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/v1/user/john_doe/session", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/user/john_doe", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,42 @@
+package spec
+
+import "time"
+
+// AuditEntry records one change to an account: who made it, to whom, and from
+// where. Secrets such as password hashes never appear in Changes.
+type AuditEntry struct {
+	ID   uint
+	Time time.Time
+	// Actor is the username the change was made as
+	Actor string
+	// Target is the username of the account that was changed
+	Target    string
+	Action    string
+	Changes   []FieldChange
+	IP        string
+	RequestID string
+}
+
+// FieldChange is the value of a field before and after a change. Before is nil
+// for a new value and After is nil for a removed one; both are nil for secrets,
+// whose change is recorded but not their value.
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before any    `json:"before,omitempty"`
+	After  any    `json:"after,omitempty"`
+}
+
+// AuditQuery selects audit entries. Zero fields do not restrict the result.
+type AuditQuery struct {
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// AuditLog is append-only storage for audit entries.
+type AuditLog interface {
+	AppendAudit(entry AuditEntry) error
+	// ReadAudit returns the entries matching query, newest first
+	ReadAudit(query AuditQuery) ([]AuditEntry, error)
+}
@@ -0,0 +1,64 @@
+package spec
+
+import "time"
+
+// Credential is a WebAuthn public key credential (passkey) registered by a user.
+type Credential struct {
+	ID              []byte
+	Username        string
+	PublicKey       []byte
+	AttestationType string
+	Transports      []string
+	AAGUID          []byte
+	SignCount       uint32
+	UserPresent     bool
+	UserVerified    bool
+	BackupEligible  bool
+	BackupState     bool
+	CreatedAt       time.Time
+}
+
+// Session is a bearer token issued by a successful login. Only the SHA-256
+// hash of the token is stored.
+type Session struct {
+	TokenHash string
+	Username  string
+	// Method is how the user logged in, "password" or "passkey"
+	Method    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// PasswordReset lets whoever holds its token set the user's password once,
+// until it expires. Only the SHA-256 hash of the token is stored.
+type PasswordReset struct {
+	TokenHash string
+	Username  string
+	ExpiresAt time.Time
+}
+
+// LoginAttempt is one try to log in with a password or passkey, successful or
+// not.
+type LoginAttempt struct {
+	Username  string
+	Time      time.Time
+	IP        string
+	UserAgent string
+	// Method is "password" or "passkey"
+	Method string
+	// Outcome is "success" or why the attempt failed
+	Outcome string
+}
+
+// APIKey lets a service call the API on behalf of its owner, limited to its
+// scopes. Only the SHA-256 hash of the key is stored; ID is the non-secret
+// part of the key and identifies it.
+type APIKey struct {
+	ID        string
+	Username  string
+	Name      string
+	Hash      string
+	Scopes    []string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
@@ -1,9 +1,106 @@
 package spec
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrVersionConflict is returned by Update when the stored user has changed
+// since it was read.
+var ErrVersionConflict = errors.New("user was changed concurrently")
+
 type DbInterface interface {
+	AuditLog
+	// WithContext returns a DbInterface whose queries run with ctx, so they
+	// are cancelled with the request and logged with its request ID
+	WithContext(ctx context.Context) DbInterface
+	// Ping checks that the database can be reached
+	Ping() error
+	// CheckMigrations reports a table or column the schema is missing
+	CheckMigrations() error
+	// Close closes the connection pool
+	Close() error
+	// Transaction runs fn with a DbInterface whose writes are committed
+	// together if fn returns nil, and rolled back otherwise
+	Transaction(fn func(tx DbInterface) error) error
 	Create(user User) error
 	ReadAll() ([]User, error)
 	Read(username string) (User, error)
+	// Update writes the password hash, profile and admin flag of user,
+	// including zero values, if its stored Version is still user.Version, and
+	// increments the stored Version. Otherwise it returns ErrVersionConflict.
+	// The TOTP, status and deletion fields have methods of their own.
 	Update(user User) error
+	// UpdateFields is Update limited to the named User fields, which are
+	// written even if they are zero
+	UpdateFields(user User, fields []string) error
+	// Delete soft-deletes the user, who can be restored until purged
 	Delete(user User) error
+	// UpdateStatus writes the status fields of user, including zero values,
+	// whether or not the user is deleted. Like Update it checks and
+	// increments the Version.
+	UpdateStatus(user User) error
+	// ReadDeleted returns a soft-deleted user
+	ReadDeleted(username string) (User, error)
+	// Restore undoes the soft deletion of a user
+	Restore(username string) error
+	// PurgeDeleted permanently deletes the users soft-deleted before cutoff,
+	// with their credentials, sessions and keys, and returns their usernames
+	PurgeDeleted(cutoff time.Time) ([]string, error)
+	// UpdateTOTP writes the TOTP fields of user, including zero values
+	UpdateTOTP(user User) error
+	// UseTOTPStep stores step as the last accepted TOTP time step of the user
+	// and reports whether it is later than the one stored before
+	UseTOTPStep(username string, step int64) (bool, error)
+	// ReplaceRecoveryCodes discards the user's recovery codes and stores the given hashes
+	ReplaceRecoveryCodes(username string, hashes []string) error
+	// ConsumeRecoveryCode deletes the recovery code with the given hash and
+	// reports whether it existed
+	ConsumeRecoveryCode(username string, hash string) (bool, error)
+	CreateCredential(credential Credential) error
+	ReadCredentials(username string) ([]Credential, error)
+	// UpdateCredential writes the sign count and backup state after a login
+	UpdateCredential(credential Credential) error
+	CreateSession(session Session) error
+	ReadSession(tokenHash string) (Session, error)
+	ReadSessions(username string) ([]Session, error)
+	DeleteSession(tokenHash string) error
+	// DeleteSessions revokes every session of the user except the one with
+	// the given token hash
+	DeleteSessions(username string, exceptTokenHash string) error
+	CreatePasswordReset(reset PasswordReset) error
+	// ConsumePasswordReset deletes the password reset with the given token
+	// hash and returns it, so each token can only be used once
+	ConsumePasswordReset(tokenHash string) (PasswordReset, error)
+	CreateLoginAttempt(attempt LoginAttempt) error
+	// ReadLoginAttempts returns the latest limit login attempts of the user,
+	// or all of them if limit is 0, newest first
+	ReadLoginAttempts(username string, limit int) ([]LoginAttempt, error)
+	// PruneLoginAttempts deletes the login attempts made before cutoff and
+	// returns how many there were
+	PruneLoginAttempts(cutoff time.Time) (int64, error)
+	CreateAPIKey(key APIKey) error
+	ReadAPIKey(id string) (APIKey, error)
+	ReadAPIKeys(username string) ([]APIKey, error)
+	DeleteAPIKey(id string) error
+	CreateOAuthClient(client OAuthClient) error
+	ReadOAuthClient(id string) (OAuthClient, error)
+	// SaveOAuthConsent creates or replaces the consent of a user for a client
+	SaveOAuthConsent(consent OAuthConsent) error
+	ReadOAuthConsent(username string, clientID string) (OAuthConsent, error)
+	ReadOAuthConsents(username string) ([]OAuthConsent, error)
+	// ClaimIdempotencyKey stores response unless an unexpired response with
+	// the same key exists, in which case it returns that one and false
+	ClaimIdempotencyKey(response IdempotentResponse) (IdempotentResponse, bool, error)
+	// CompleteIdempotencyKey writes the status, content type, body and expiry
+	// of a response stored by ClaimIdempotencyKey
+	CompleteIdempotencyKey(response IdempotentResponse) error
+	// DeleteIdempotencyKey forgets the response with the given key, so the
+	// request can be made again
+	DeleteIdempotencyKey(key string) error
+	// PruneIdempotencyKeys deletes the responses that expired before cutoff,
+	// then the oldest ones beyond the newest keep, and returns how many it
+	// deleted
+	PruneIdempotencyKeys(cutoff time.Time, keep int) (int64, error)
 }
@@ -0,0 +1,17 @@
+package spec
+
+import "time"
+
+// IdempotentResponse is the response to the first request made with an
+// Idempotency-Key, which is replayed to retries of that request until
+// ExpiresAt. Status is 0 while the first request is still running.
+type IdempotentResponse struct {
+	// Key identifies the client and the Idempotency-Key it sent
+	Key string
+	// Fingerprint identifies the credentials and body of the request
+	Fingerprint []byte
+	Status      int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time
+}
@@ -0,0 +1,22 @@
+package spec
+
+import "time"
+
+// OAuthClient is an application registered to sign users in through the OAuth2
+// authorization server. Public clients such as single page apps have no secret.
+type OAuthClient struct {
+	ID           string
+	Name         string
+	SecretHash   string
+	RedirectURIs []string
+	CreatedAt    time.Time
+}
+
+// OAuthConsent records the scopes a user has allowed a client, so they are not
+// asked again.
+type OAuthConsent struct {
+	Username  string
+	ClientID  string
+	Scopes    []string
+	CreatedAt time.Time
+}
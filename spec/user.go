@@ -1,9 +1,49 @@
 package spec
 
+import "time"
+
+// Account statuses. Only active users can log in; deleted users are
+// soft-deleted and can be restored until they are purged.
+const (
+	StatusPending   = "pending"
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusLocked    = "locked"
+	StatusDeleted   = "deleted"
+)
+
+// AuthSourceLDAP marks users whose password is checked by the directory.
+const AuthSourceLDAP = "ldap"
+
 type User struct {
 	Username string
 	Hash     string
 	Email    string
 	Name     string
 	Age      uint
+	// TOTPSecret is the base32 TOTP key, set once enrollment starts
+	TOTPSecret string
+	// TOTPEnabled is set once enrollment is confirmed and the second factor is enforced
+	TOTPEnabled bool
+	// TOTPLastStep is the time step of the last accepted TOTP code, so a code
+	// cannot be used twice
+	TOTPLastStep int64
+	// Admin users may act on any user's account. It can only be set in the database.
+	Admin bool
+	// AuthSource is the AuthProvider that owns the account, empty for local
+	// accounts. Directory logins only match accounts owned by the directory.
+	// Like Admin it can only be changed in the database.
+	AuthSource string
+	// Version is incremented by every Update, so concurrent writers can be detected
+	Version uint
+	// Status is one of the Status constants, changed with a reason at StatusChangedAt
+	Status          string
+	StatusReason    string
+	StatusChangedAt time.Time
+	// PreviousStatus and PreviousStatusReason are the status a deleted user had
+	// before it was deleted, which restoring it returns to
+	PreviousStatus       string
+	PreviousStatusReason string
+	// DeletedAt is when the user was soft-deleted, zero for a live user
+	DeletedAt time.Time
 }